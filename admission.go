@@ -0,0 +1,124 @@
+package decap
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// MaxWindows limits the number of open window sessions. In
+	// ProcessPerWindow mode this is also the maximum number of browsers.
+	// Zero means no limit.
+	MaxWindows int
+	// MaxTabs limits the number of tabs executing requests concurrently.
+	// Zero means no limit.
+	MaxTabs int
+	// MaxQueueWait is how long a request may wait for a free window or tab
+	// before failing with ErrOverloaded.
+	MaxQueueWait = 10 * time.Second
+
+	ErrOverloaded = errors.New("no free browser capacity, try again later")
+
+	errNoWindowSlot = errors.New("no free window slot")
+	errProfileBusy  = errors.New("persistent profile is being closed")
+
+	tabSlots    = &limiter{limit: func() int { return MaxTabs }}
+	windowSlots = &limiter{limit: func() int { return MaxWindows }}
+)
+
+type Stats struct {
+	Windows     int `json:"windows"`
+	SavedTabs   int `json:"saved_tabs"`
+	ActiveTabs  int `json:"active_tabs"`
+	WindowQueue int `json:"window_queue"`
+	TabQueue    int `json:"tab_queue"`
+}
+
+// CurrentStats reports the number of open windows and tabs, and how many
+// requests are queued waiting for either.
+func CurrentStats() Stats {
+	var st Stats
+	windows := Windows()
+	st.Windows = len(windows)
+	for _, w := range windows {
+		st.SavedTabs += len(w.Tabs)
+	}
+	st.ActiveTabs, st.TabQueue = tabSlots.usage()
+	_, st.WindowQueue = windowSlots.usage()
+	return st
+}
+
+// A limiter hands out a limited number of slots to waiters in FIFO order.
+type limiter struct {
+	limit   func() int
+	mu      sync.Mutex
+	used    int
+	waiting []chan struct{}
+}
+
+func (l *limiter) acquire(maxWait time.Duration) error {
+	l.mu.Lock()
+	if l.free() {
+		l.used++
+		l.mu.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	l.waiting = append(l.waiting, ch)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, c := range l.waiting {
+		if c == ch {
+			l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+			return ErrOverloaded
+		}
+	}
+	// the slot was handed over just as the timer fired
+	return nil
+}
+
+func (l *limiter) tryAcquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.free() {
+		return false
+	}
+	l.used++
+	return true
+}
+
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.waiting) > 0 {
+		// hand the slot directly to the longest waiting request
+		close(l.waiting[0])
+		l.waiting = l.waiting[1:]
+		return
+	}
+	if l.used > 0 {
+		l.used--
+	}
+}
+
+func (l *limiter) free() bool {
+	limit := l.limit()
+	return len(l.waiting) == 0 && (limit <= 0 || l.used < limit)
+}
+
+func (l *limiter) usage() (used, queued int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.used, len(l.waiting)
+}
@@ -0,0 +1,158 @@
+package decap
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// An ArtifactStore keeps the screenshots and PDFs of requests with
+// artifact_url set, so that clients can fetch them by URL instead of
+// receiving them in the response.
+type ArtifactStore interface {
+	// Put stores data under name and returns the URL it can be fetched from.
+	Put(ctx context.Context, name, contentType string, data []byte) (string, error)
+	// DeleteBefore deletes the artifacts stored before t and returns how
+	// many were deleted.
+	DeleteBefore(ctx context.Context, t time.Time) (int, error)
+}
+
+var (
+	// Artifacts is where artifacts are stored. Requests can't set
+	// artifact_url if it is nil.
+	Artifacts ArtifactStore
+	// ArtifactRetention is how long artifacts are kept by ExpireArtifacts.
+	// Zero means forever.
+	ArtifactRetention time.Duration
+)
+
+// ExpireArtifacts deletes artifacts older than ArtifactRetention from
+// Artifacts every interval. It never returns, unless interval isn't positive.
+func ExpireArtifacts(interval time.Duration) {
+	if interval <= 0 {
+		Logger.Error("Artifact cleanup interval must be positive, not expiring artifacts", "interval", interval)
+		return
+	}
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		if Artifacts == nil || ArtifactRetention <= 0 {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		n, err := Artifacts.DeleteBefore(ctx, time.Now().Add(-ArtifactRetention))
+		cancel()
+		if err != nil {
+			Logger.Warn("Couldn't delete expired artifacts", "deleted", n, "err", err)
+		} else if n > 0 {
+			Logger.Info("Deleted expired artifacts", "deleted", n)
+		}
+	}
+}
+
+func (r *Request) parseArtifactURL() error {
+	if r.ArtifactURL && Artifacts == nil {
+		return fmt.Errorf("artifact_url: no artifact store is configured")
+	}
+	return nil
+}
+
+// storeArtifact moves the screenshot or PDF of the result to Artifacts and
+// replaces it with its URL.
+func (r *Request) storeArtifact() (err error) {
+	var data []byte
+	var ext, contentType string
+	switch r.res.Type() {
+	case "png":
+		data, ext, contentType = r.res.img, ".png", "image/png"
+	case "pdf":
+		data, ext, contentType = r.res.pdf, ".pdf", "application/pdf"
+	default:
+		return nil
+	}
+	ctx, span := r.startSpan("decap.store_artifact", attribute.Int("decap.artifact_bytes", len(data)))
+	defer func() { endSpan(span, err) }()
+
+	var buf [16]byte
+	if _, err = rand.Read(buf[:]); err != nil {
+		return err
+	}
+	name := hex.EncodeToString(buf[:]) + ext
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	r.res.ArtifactURL, err = Artifacts.Put(ctx, name, contentType, data)
+	if err != nil {
+		return fmt.Errorf("couldn't store artifact: %s", err)
+	}
+	r.res.img = nil
+	r.res.pdf = nil
+	return nil
+}
+
+// A FileStore keeps artifacts in a directory. The program is expected to
+// serve the directory at BaseURL.
+type FileStore struct {
+	Dir     string
+	BaseURL string
+}
+
+func NewFileStore(dir, baseURL string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &FileStore{Dir: dir, BaseURL: strings.TrimSuffix(baseURL, "/")}, nil
+}
+
+func (s *FileStore) Put(ctx context.Context, name, contentType string, data []byte) (string, error) {
+	if !ValidArtifactName(name) {
+		return "", fmt.Errorf(`invalid artifact name "%s"`, name)
+	}
+	if err := writeFileAtomic(filepath.Join(s.Dir, name), data); err != nil {
+		return "", err
+	}
+	return s.BaseURL + "/" + url.PathEscape(name), nil
+}
+
+func (s *FileStore) DeleteBefore(ctx context.Context, t time.Time) (int, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, de := range entries {
+		if err = ctx.Err(); err != nil {
+			return n, err
+		}
+		if !ValidArtifactName(de.Name()) {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil || !info.Mode().IsRegular() || !info.ModTime().Before(t) {
+			continue
+		}
+		if err = os.Remove(filepath.Join(s.Dir, de.Name())); err != nil && !os.IsNotExist(err) {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// ValidArtifactName reports whether name can be the name of an artifact, so
+// that programs serving a FileStore don't serve other files, and so that the
+// stores don't delete them.
+func ValidArtifactName(name string) bool {
+	base, ext, _ := strings.Cut(name, ".")
+	if ext != "png" && ext != "pdf" || len(base) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(base)
+	return err == nil
+}
@@ -2,29 +2,59 @@ package decap
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/chromedp/cdproto/cdp"
 	"github.com/chromedp/cdproto/dom"
+	"github.com/chromedp/cdproto/network"
 	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/cdproto/target"
 	"github.com/chromedp/chromedp"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
-	debugMode    bool
-	scrollCmd    string
-	tabLoadQuery = make(chan string)
-	tabLoadReply = make(chan session)
-	tabSave      = make(chan session)
-	windowClose  = make(chan string)
-	windowQuery  = make(chan session)
-	windowReply  = make(chan session)
-	tabRegexp    = regexp.MustCompile(`^([[:xdigit:]]{8,})_([[:xdigit:]]{8})$`)
+	// ProcessPerWindow makes each window session run in a Chrome process of its
+	// own instead of an incognito browser context in a shared browser. It is
+	// ignored for RemoteBrowsers, which aren't launched by decap. Launch
+	// profiles can't set a UserDataDir in this mode, since Chrome locks it.
+	ProcessPerWindow bool
+	// BrowserPoolSize is the number of shared browsers that window sessions are
+	// spread across when ProcessPerWindow is false.
+	BrowserPoolSize = 1
+	// RemoteBrowsers lists DevTools websocket URLs (e.g. "ws://chrome:9222")
+	// of already running browsers. If set, decap connects to these round-robin
+	// instead of launching Chrome itself.
+	RemoteBrowsers []string
+	// WindowTimeout is how long a window session is kept open after its last
+	// request, unless a request had a longer timeout.
+	WindowTimeout = 30 * time.Second
+	// GCInterval is how often idle windows are closed and warm tabs are
+	// refilled.
+	GCInterval = 2 * time.Second
+
+	debugMode        bool
+	scrollCmd        string
+	infoQuery        = make(chan string)
+	infoReply        = make(chan []WindowInfo)
+	tabClose         = make(chan string)
+	tabCloseReply    = make(chan bool)
+	tabLoadQuery     = make(chan session)
+	tabLoadReply     = make(chan session)
+	tabSave          = make(chan session)
+	windowClose      = make(chan string)
+	windowCloseReply = make(chan bool)
+	windowQuery      = make(chan session)
+	windowReply      = make(chan session)
+	tabRegexp        = regexp.MustCompile(`^([[:xdigit:]]{8,})_([[:xdigit:]]{8})$`)
 )
 
 func init() {
@@ -42,24 +72,109 @@ func init() {
 }
 
 type session struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	browser  *browser
+	crashed  *atomic.Bool
+	err      error
+	id       string
+	last     time.Time
+	owner    string
+	reserved bool
+	spec     windowSpec
+	timeout  time.Duration
+	watched  <-chan struct{}
+}
+
+// A windowSpec describes how the browser context of a window is set up.
+// Requests can only share a window session if they agree on its spec.
+type windowSpec struct {
+	profile     string
+	proxy       string
+	proxyUser   string
+	userProfile string
+}
+
+type browser struct {
 	ctx     context.Context
 	cancel  context.CancelFunc
-	id      string
-	last    time.Time
-	timeout time.Duration
+	windows int
+}
+
+// A browserPool holds the shared browsers of each launch profile.
+type browserPool map[string][]*browser
+
+type WindowInfo struct {
+	ID       string    `json:"id"`
+	LastUsed time.Time `json:"last_used"`
+	Owner    string    `json:"owner,omitempty"`
+	Timeout  string    `json:"timeout"`
+	Tabs     []TabInfo `json:"tabs"`
+}
+
+type TabInfo struct {
+	ID       string    `json:"id"`
+	LastUsed time.Time `json:"last_used"`
+	Timeout  string    `json:"timeout"`
+}
+
+func loadWindow(id string, spec windowSpec, owner string, timeout time.Duration) session {
+	q := session{id: id, spec: spec, owner: owner, timeout: timeout}
+	for {
+		windowQuery <- q
+		w := <-windowReply
+		switch w.err {
+		case errNoWindowSlot:
+			// queue up for a window slot outside of the allocator and try again
+			if err := windowSlots.acquire(MaxQueueWait); err != nil {
+				return session{id: id, err: err}
+			}
+			q.reserved = true
+		case errProfileBusy:
+			// the allocator has released the reserved slot, if any
+			waitForProfile(spec.userProfile)
+			q.reserved = false
+		default:
+			return w
+		}
+	}
+}
+
+// Windows lists the open window sessions and their saved tabs.
+func Windows() []WindowInfo {
+	infoQuery <- ""
+	return <-infoReply
 }
 
-func loadWindow(id string, timeout time.Duration) session {
-	windowQuery <- session{id: id, timeout: timeout}
-	return <-windowReply
+// LookupWindow returns the window session with the given ID, if it's open.
+func LookupWindow(id string) (WindowInfo, bool) {
+	if id == "" {
+		return WindowInfo{}, false
+	}
+	infoQuery <- id
+	windows := <-infoReply
+	if len(windows) == 0 {
+		return WindowInfo{}, false
+	}
+	return windows[0], true
 }
 
-func closeWindow(id string) {
+// CloseWindow shuts down a window session including its tabs. It reports
+// whether the window existed.
+func CloseWindow(id string) bool {
 	windowClose <- id
+	return <-windowCloseReply
 }
 
-func loadTab(id string) session {
-	tabLoadQuery <- id
+// CloseTab closes a tab saved with reuse_tab. It reports whether the tab
+// existed.
+func CloseTab(id string) bool {
+	tabClose <- id
+	return <-tabCloseReply
+}
+
+func loadTab(id, owner string) session {
+	tabLoadQuery <- session{id: id, owner: owner}
 	return <-tabLoadReply
 }
 
@@ -68,19 +183,60 @@ func (ses session) saveTab() {
 }
 
 func AllocateSessions() {
-	GCInterval := time.NewTicker(2 * time.Second)
+	gcTicker := time.NewTicker(GCInterval)
 	rand.Seed(time.Now().UnixNano())
 
 	windows := make(map[string]session)
 	tabs := make(map[string]session)
+	browsers := make(browserPool)
+	var warm []warmTab
+	var warmPending int
+	var stopped bool
 
 	for {
 		select {
 		case q := <-windowQuery:
+			if stopped {
+				if q.reserved {
+					windowSlots.release()
+				}
+				windowReply <- session{id: q.id, err: ErrShutdown}
+				break
+			}
 			w, ok := windows[q.id]
 			if !ok {
-				w = createWindow(q.id)
-				w.timeout = 30 * time.Second
+				w, ok = profileWindow(q.spec.userProfile, windows)
+			}
+			if ok && q.reserved {
+				windowSlots.release()
+			}
+			if ok && w.owner != q.owner {
+				windowReply <- session{id: q.id, err: fmt.Errorf("window session %s belongs to another client", w.id)}
+				break
+			}
+			if ok && w.spec != q.spec {
+				windowReply <- session{id: q.id, err: w.spec.mismatch(q.spec, w.id)}
+				break
+			}
+			if !ok && q.spec.userProfile != "" && profileBusy(q.spec.userProfile) {
+				if q.reserved {
+					windowSlots.release()
+				}
+				windowReply <- session{id: q.id, err: errProfileBusy}
+				break
+			}
+			if !ok {
+				if !q.reserved && !acquireWindowSlot(&warm) {
+					windowReply <- session{id: q.id, err: errNoWindowSlot}
+					break
+				}
+				w = createWindow(q, browsers)
+				if w.err != nil {
+					windowSlots.release()
+					windowReply <- w
+					break
+				}
+				w.timeout = WindowTimeout
 			}
 			if q.timeout > w.timeout {
 				w.timeout = q.timeout
@@ -89,40 +245,131 @@ func AllocateSessions() {
 			windowReply <- w
 			windows[w.id] = w
 
+		case timeout := <-warmQuery:
+			var t session
+			for len(warm) > 0 && t.ctx == nil {
+				wt := warm[0]
+				warm = warm[1:]
+				if wt.tab.ctx.Err() != nil {
+					discardWarmTab(wt)
+					continue
+				}
+				w := wt.window
+				w.last = time.Now()
+				w.timeout = WindowTimeout
+				if timeout > w.timeout {
+					w.timeout = timeout
+				}
+				windows[w.id] = w
+				t = wt.tab
+			}
+			warmReply <- t
+			if !stopped {
+				warmPending += refillWarmTabs(len(warm)+warmPending, browsers)
+			}
+
+		case wt := <-warmReady:
+			warmPending--
+			if wt.window.err != nil {
+				Logger.Warn("Couldn't prepare warm tab", "err", wt.window.err)
+				discardWarmTab(wt)
+				break
+			}
+			if stopped {
+				discardWarmTab(wt)
+				break
+			}
+			warm = append(warm, wt)
+
+		case <-shutdownQuery:
+			stopped = true
+			for _, wt := range warm {
+				discardWarmTab(wt)
+			}
+			warm = nil
+			n := closeAllWindows(&windows, &tabs)
+			browsers.closeAll()
+			shutdownReply <- n
+
+		case c := <-windowCrash:
+			w, ok := windows[c.id]
+			if !ok || (w.ctx != c.ctx && w.ctx.Err() == nil) {
+				break
+			}
+			Logger.Warn("Window crashed, evicting it", "session", w.id)
+			windowEvictions.WithLabelValues("crash").Inc()
+			w.shutdown()
+			removeWindow(w.id, &windows, &tabs)
+
+		case id := <-windowEvict:
+			w, ok := windows[id]
+			if !ok {
+				break
+			}
+			Logger.Warn("Window crashed, evicting it", "session", w.id)
+			windowEvictions.WithLabelValues("crash").Inc()
+			w.shutdown()
+			removeWindow(w.id, &windows, &tabs)
+
+		case id := <-infoQuery:
+			infoReply <- windowInfo(id, windows, tabs)
+
+		case <-browserQuery:
+			browserReply <- browserRefs(windows, browsers)
+
 		case id := <-windowClose:
-			if w, ok := windows[id]; ok {
+			w, ok := windows[id]
+			if ok {
 				w.shutdown()
-				delete(windows, id)
+				removeWindow(w.id, &windows, &tabs)
+			}
+			windowCloseReply <- ok
+
+		case id := <-tabClose:
+			t, ok := tabs[id]
+			if ok {
+				t.shutdown()
+				delete(tabs, id)
+				Logger.Info("Closing tab", "tab", id)
 			}
+			tabCloseReply <- ok
 
 		case t := <-tabSave:
+			t.last = time.Now()
 			tabs[t.id] = t
 
-		case id := <-tabLoadQuery:
+		case q := <-tabLoadQuery:
+			id := q.id
+			if t, ok := tabs[id]; ok && t.owner != q.owner {
+				tabLoadReply <- session{}
+				break
+			}
 			tabLoadReply <- tabs[id]
 			delete(tabs, id)
 
 			prefix, _, err := parseTabID(id)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Tab ID parse error: %s\n", err)
+				Logger.Warn("Tab ID parse error", "err", err)
 				break
 			}
 			if w, ok := windows[prefix]; ok {
 				w.last = time.Now()
 				windows[prefix] = w
 			} else {
-				fmt.Fprintf(os.Stderr, "Tab ID (%s) didn't match any window\n", id)
+				Logger.Warn("Tab ID didn't match any window", "tab", id)
 			}
 
-		case <-GCInterval.C:
+		case <-gcTicker.C:
+			if !stopped {
+				warmPending += refillWarmTabs(len(warm)+warmPending, browsers)
+			}
 			for _, w := range windows {
 				if elapsed := time.Since(w.last); elapsed > w.timeout {
-					fmt.Fprintf(os.Stderr,
-						"Window (session %s) was last requested %.1f seconds ago, closing it\n",
-						w.id, elapsed.Seconds())
+					Logger.Info("Window timed out, closing it", "session", w.id,
+						"idle", elapsed.Round(100*time.Millisecond).String())
+					windowEvictions.WithLabelValues("timeout").Inc()
 					w.shutdown()
-					msg := removeWindow(w.id, &windows, &tabs)
-					fmt.Fprintln(os.Stderr, msg)
+					removeWindow(w.id, &windows, &tabs)
 				}
 			}
 		}
@@ -139,7 +386,40 @@ func parseTabID(id string) (prefix, suffix string, err error) {
 	return
 }
 
-func removeWindow(id string, windows, tabs *map[string]session) string {
+// windowInfo describes the window with the given ID, or all windows if id is
+// empty.
+func windowInfo(id string, windows, tabs map[string]session) []WindowInfo {
+	infos := make([]WindowInfo, 0)
+	for _, w := range windows {
+		if id != "" && w.id != id {
+			continue
+		}
+		info := WindowInfo{
+			ID:       w.id,
+			LastUsed: w.last,
+			Owner:    w.owner,
+			Timeout:  w.timeout.String(),
+			Tabs:     make([]TabInfo, 0),
+		}
+		for _, t := range tabs {
+			if prefix, _, _ := parseTabID(t.id); prefix == w.id {
+				info.Tabs = append(info.Tabs, TabInfo{t.id, t.last, t.timeout.String()})
+			}
+		}
+		sort.Slice(info.Tabs, func(i, j int) bool { return info.Tabs[i].ID < info.Tabs[j].ID })
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+func removeWindow(id string, windows, tabs *map[string]session) {
+	if w, ok := (*windows)[id]; ok {
+		if w.browser != nil {
+			w.browser.windows--
+		}
+		windowSlots.release()
+	}
 	delete(*windows, id)
 	var tabLog []string
 	for tid := range *tabs {
@@ -150,32 +430,162 @@ func removeWindow(id string, windows, tabs *map[string]session) string {
 		}
 	}
 	if len(tabLog) == 0 {
-		return fmt.Sprintf("Deleting window %s", id)
+		Logger.Info("Deleting window", "session", id)
+		return
 	}
-	return fmt.Sprintf("Deleting window %s including tabs %v", id, tabLog)
+	Logger.Info("Deleting window including tabs", "session", id, "tabs", tabLog)
 }
 
-func createWindow(id string) session {
-	var ctx context.Context
-	var cancel context.CancelFunc
-	if debugMode {
-		ctx, cancel = chromedp.NewExecAllocator(context.Background())
+func createWindow(q session, browsers browserPool) session {
+	w := session{spec: q.spec, owner: q.owner}
+	if len(q.id) < 8 {
+		w.id = createSessionID()
 	} else {
-		ctx, cancel = chromedp.NewContext(context.Background())
+		w.id = q.id
 	}
-	var w session
-	w.cancel = cancel
-	if len(id) < 8 {
-		w.id = createSessionID()
+	if !processPerWindow() && w.spec.userProfile == "" {
+		w.browser, w.err = browsers.pick(w.spec.profile)
+		if w.err != nil {
+			return w
+		}
+		w.browser.windows++
+	}
+	return w.open()
+}
+
+// open starts the browser or browser context of a window. Unlike
+// createWindow, it doesn't touch allocator state, so it can be run outside of
+// AllocateSessions.
+func (w session) open() session {
+	if w.browser == nil {
+		var ctx context.Context
+		ctx, allocCancel := newAllocator(w.spec)
+		// create a persistent dummy tab to keep the window open
+		w.ctx, _ = chromedp.NewContext(ctx)
+		w.cancel = allocCancel
+		if w.spec.userProfile != "" {
+			w.cancel = closeGracefully(w.ctx, w.spec.userProfile, allocCancel)
+		}
 	} else {
-		w.id = id
+		// the dummy tab owns the incognito browser context of the window,
+		// which is disposed when the tab is closed
+		w.ctx, w.cancel = chromedp.NewContext(w.browser.ctx, w.spec.browserContext())
+	}
+	actions := []chromedp.Action{chromedp.Navigate("about:blank")}
+	if w.browser == nil {
+		actions = append([]chromedp.Action{chromedp.ActionFunc(Policy.enforce)}, actions...)
 	}
+	if err := chromedp.Run(w.ctx, actions...); err != nil {
+		w.cancel()
+		w.err = fmt.Errorf("couldn't open window: %s", err)
+		return w
+	}
+	w.watchWindow()
+	return w
+}
 
-	// create a persistent dummy tab to keep the window open
-	w.ctx, _ = chromedp.NewContext(ctx)
-	chromedp.Run(w.ctx, chromedp.Navigate("about:blank"))
+var nextRemote atomic.Uint64
 
-	return w
+func newAllocator(spec windowSpec) (context.Context, context.CancelFunc) {
+	if len(RemoteBrowsers) > 0 {
+		i := (nextRemote.Add(1) - 1) % uint64(len(RemoteBrowsers))
+		return chromedp.NewRemoteAllocator(context.Background(), RemoteBrowsers[i])
+	}
+	p := launchProfile(spec.profile)
+	if spec.proxy != "" {
+		p.ProxyServer = spec.proxy
+	}
+	if spec.userProfile != "" {
+		p.UserDataDir = profileUserDataDir(spec.userProfile)
+	}
+	return chromedp.NewExecAllocator(context.Background(), p.allocatorOptions()...)
+}
+
+// browserContext creates the incognito browser context of a window in a
+// shared browser.
+func (spec windowSpec) browserContext() chromedp.ContextOption {
+	if spec.proxy == "" {
+		return chromedp.WithNewBrowserContext()
+	}
+	return chromedp.WithNewBrowserContext(
+		func(p *target.CreateBrowserContextParams) *target.CreateBrowserContextParams {
+			return p.WithProxyServer(spec.proxy)
+		})
+}
+
+func (spec windowSpec) mismatch(q windowSpec, id string) error {
+	if spec.profile != q.profile {
+		return fmt.Errorf(`window session %s uses browser profile "%s"`, id, spec.profile)
+	}
+	if spec.userProfile != q.userProfile {
+		if spec.userProfile == "" {
+			return fmt.Errorf("window session %s doesn't use a persistent profile", id)
+		}
+		return fmt.Errorf(`window session %s uses persistent profile "%s"`, id, spec.userProfile)
+	}
+	if spec.proxy == "" {
+		return fmt.Errorf("window session %s doesn't use a proxy", id)
+	}
+	return fmt.Errorf("window session %s uses a different proxy", id)
+}
+
+// pick returns the least busy browser of a launch profile, starting a new one
+// if the pool isn't full yet and all running browsers are in use.
+func (pool browserPool) pick(profile string) (*browser, error) {
+	var least *browser
+	live := pool[profile][:0]
+	for _, b := range pool[profile] {
+		if b.ctx.Err() != nil {
+			Logger.Warn("Shared browser has exited, discarding it", "profile", profile)
+			b.cancel()
+			continue
+		}
+		live = append(live, b)
+		if least == nil || b.windows < least.windows {
+			least = b
+		}
+	}
+	pool[profile] = live
+	size := poolSize()
+	if launchProfile(profile).UserDataDir != "" {
+		// browsers can't share a user data directory
+		size = 1
+	}
+	if least != nil && (least.windows == 0 || len(live) >= size) {
+		return least, nil
+	}
+
+	allocCtx, allocCancel := newAllocator(windowSpec{profile: profile})
+	ctx, cancel := chromedp.NewContext(allocCtx)
+	if err := chromedp.Run(ctx, chromedp.ActionFunc(Policy.enforce)); err != nil {
+		cancel()
+		allocCancel()
+		if least != nil {
+			return least, nil
+		}
+		return nil, fmt.Errorf("couldn't start browser: %s", err)
+	}
+	b := &browser{ctx: ctx, cancel: func() { cancel(); allocCancel() }}
+	pool[profile] = append(pool[profile], b)
+	Logger.Info("Started shared browser", "profile", profile,
+		"browser", len(pool[profile]), "pool_size", size)
+	return b, nil
+}
+
+// processPerWindow reports whether windows get browsers of their own. Windows
+// in remote browsers are always incognito contexts, since a plain tab would
+// share the cookies and storage of the browser's default context.
+func processPerWindow() bool {
+	return ProcessPerWindow && len(RemoteBrowsers) == 0
+}
+
+// poolSize is the number of shared browsers, which is at least one per remote
+// browser.
+func poolSize() int {
+	if len(RemoteBrowsers) > BrowserPoolSize {
+		return len(RemoteBrowsers)
+	}
+	return BrowserPoolSize
 }
 
 func createSessionID() string {
@@ -184,27 +594,45 @@ func createSessionID() string {
 
 func (ses session) createSiblingTabWithTimeout(timeout time.Duration) session {
 	if timeout > ses.timeout {
-		ses = loadWindow(ses.id, timeout)
+		ses = loadWindow(ses.id, ses.spec, ses.owner, timeout)
 	}
+	return ses.createSiblingTab().withTimeout(timeout)
+}
+
+func (ses session) createSiblingTab() session {
 	id := fmt.Sprintf("%s_%s", ses.id, createSessionID())
-	sibling := session{id: id, timeout: timeout}
-	sibling.ctx, _ = chromedp.NewContext(ses.ctx)
-	sibling.ctx, _ = context.WithTimeout(sibling.ctx, timeout)
-	sibling.cancel = context.CancelFunc(func() {
-		chromedp.Run(sibling.ctx, page.Close())
-	})
+	sibling := session{id: id, owner: ses.owner}
+	sibling.ctx, sibling.cancel = chromedp.NewContext(ses.ctx)
+	sibling.watchTab()
 	return sibling
 }
 
+func (ses session) withTimeout(timeout time.Duration) session {
+	closeTab := ses.cancel
+	ctx, cancel := context.WithTimeout(ses.ctx, timeout)
+	ses.ctx = ctx
+	ses.timeout = timeout
+	ses.cancel = func() {
+		cancel()
+		closeTab()
+	}
+	return ses
+}
+
 func (ses *session) shutdown() {
 	if ses.cancel == nil {
-		msg := "Expected non-nil cancelFunc when shutting down tab/window (session %s)\n"
-		fmt.Fprintf(os.Stderr, msg, ses.id)
+		Logger.Error("Expected non-nil cancelFunc when shutting down tab/window", "session", ses.id)
 		return
 	}
 	ses.cancel()
 }
 
+func clearCookies() chromedp.ActionFunc {
+	return func(ctx context.Context) error {
+		return network.ClearBrowserCookies().Do(ctx)
+	}
+}
+
 func click(sel string) chromedp.ActionFunc {
 	return func(ctx context.Context) error {
 		return chromedp.Click(sel, chromedp.NodeVisible).Do(ctx)
@@ -255,6 +683,25 @@ func enableLifecycleEvents() chromedp.ActionFunc {
 	}
 }
 
+func getCookies(urls []string, out *[]string) chromedp.ActionFunc {
+	return func(ctx context.Context) error {
+		p := network.GetCookies()
+		if len(urls) > 0 {
+			p = p.WithUrls(urls)
+		}
+		cookies, err := p.Do(ctx)
+		if err != nil {
+			return err
+		}
+		if cookies == nil {
+			cookies = make([]*network.Cookie, 0)
+		}
+		buf, err := json.Marshal(cookies)
+		*out = append(*out, string(buf))
+		return err
+	}
+}
+
 func hideElements(sel string) chromedp.ActionFunc {
 	return func(ctx context.Context) error {
 		cmd := fmt.Sprintf(`document.querySelectorAll('%s').forEach(e => e.style.visibility = "hidden");`, sel)
@@ -303,6 +750,12 @@ func removeElements(sel string) chromedp.ActionFunc {
 	}
 }
 
+func setCookies(cookies []*network.CookieParam) chromedp.ActionFunc {
+	return func(ctx context.Context) error {
+		return network.SetCookies(cookies).Do(ctx)
+	}
+}
+
 func screenshot(args map[string]string, buf *[]byte) chromedp.ActionFunc {
 	return func(ctx context.Context) error {
 		var err error
@@ -335,34 +788,36 @@ func scrollToBottom() chromedp.ActionFunc {
 	}
 }
 
-func listen(id *string, events ...string) chromedp.ActionFunc {
+func listen(r *Request, events ...string) chromedp.ActionFunc {
 	return func(ctx context.Context) error {
+		span := trace.SpanFromContext(r.traceCtx)
 		mustEvents := make(map[string]bool)
 		for _, event := range events {
 			mustEvents[event] = true
 		}
 
+		start := time.Now()
 		ch := make(chan struct{})
 		cctx, cancel := context.WithCancel(ctx)
 		chromedp.ListenTarget(cctx, func(ev interface{}) {
 			switch e := ev.(type) {
 			case *page.EventLifecycleEvent:
 				if ok := mustEvents[e.Name]; ok {
-					fmt.Fprintf(os.Stderr, "%s Tab event (session %s): Caught %s\n",
-						time.Now().Format("[15:04:05]"), *id, e.Name)
+					r.log().Info("Caught tab event", "event", e.Name)
+					span.AddEvent(e.Name)
 					delete(mustEvents, e.Name)
 					if len(mustEvents) == 0 {
 						cancel()
 						close(ch)
 					}
 				} else {
-					fmt.Fprintf(os.Stderr, "%s Tab event (session %s): Ignored %s\n",
-						time.Now().Format("[15:04:05]"), *id, e.Name)
+					r.log().Debug("Ignored tab event", "event", e.Name)
 				}
 			}
 		})
 		select {
 		case <-ch:
+			listenWait.Observe(time.Since(start).Seconds())
 			return nil
 		case <-ctx.Done():
 			return ctx.Err()
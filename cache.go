@@ -0,0 +1,371 @@
+package decap
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Cache statuses reported by ExecuteCached.
+const (
+	CacheHit    = "HIT"
+	CacheMiss   = "MISS"
+	CacheBypass = "BYPASS"
+)
+
+// A ResultCache stores the results of requests under their cache key.
+// Results returned by Get are shared and must not be modified.
+type ResultCache interface {
+	Get(key string) (*Result, bool)
+	Put(key string, res *Result)
+}
+
+// Cache, when set, is used by ExecuteCached. Caching is disabled if nil.
+var Cache ResultCache
+
+// CacheKey returns a hash of the parsed request. Session fields, which don't
+// change what a page renders to, are left out, so that identical queries from
+// different sessions share cache entries.
+func (r *Request) CacheKey() string {
+	c := *r
+	c.SessionID = ""
+	c.ReuseTab = false
+	c.ReuseWindow = false
+	c.RetryOnCrash = false
+	c.Timeout = ""
+	c.RenderDelay = ""
+	key := struct {
+		Request     *Request      `json:"request"`
+		RenderDelay time.Duration `json:"render_delay"`
+	}{&c, r.renderDelay}
+	buf, err := json.Marshal(key)
+	if err != nil {
+		// the request was decoded from JSON, so this can't happen
+		panic(fmt.Sprintf("couldn't encode cache key: %s", err))
+	}
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheable reports whether the result of the request depends only on the
+// request itself. Requests using a session, a saved tab, a storage state or a
+// persistent profile read or leave state that later requests depend on, and a
+// cache hit would skip that. The URLs of stored artifacts may expire or be
+// deleted before the cached result does.
+func (r *Request) cacheable() bool {
+	return r.newTab() && r.SessionID == "" && !r.ReuseWindow && !r.ReuseTab &&
+		r.StorageState == nil && r.Profile == "" && !r.ArtifactURL
+}
+
+// ExecuteCached is like ExecuteContext, but returns the result from Cache if
+// there is one. With noCache set the cached result is ignored but replaced by
+// the new one, and with noStore set the new result isn't cached. The status is
+// one of CacheHit, CacheMiss and CacheBypass, or empty if Cache is nil.
+func (r *Request) ExecuteCached(ctx context.Context, noCache, noStore bool) (res *Result, status string, err error) {
+	if Cache == nil {
+		res, err = r.ExecuteContext(ctx)
+		return res, "", err
+	}
+	if !r.cacheable() {
+		cacheRequests.WithLabelValues(CacheBypass).Inc()
+		res, err = r.ExecuteContext(ctx)
+		return res, CacheBypass, err
+	}
+
+	key := r.CacheKey()
+	status = CacheMiss
+	if noCache {
+		status = CacheBypass
+	} else if res, ok := Cache.Get(key); ok {
+		cacheRequests.WithLabelValues(CacheHit).Inc()
+		r.log().Info("Serving cached result", "key", key)
+		return res, CacheHit, nil
+	}
+	cacheRequests.WithLabelValues(status).Inc()
+
+	res, err = r.ExecuteContext(ctx)
+	if err == nil && !noStore {
+		Cache.Put(key, cloneResult(res))
+	}
+	return res, status, err
+}
+
+// cloneResult copies the output of a result, leaving out the IDs of the tab
+// and window it was produced in.
+func cloneResult(res *Result) *Result {
+	c := &Result{
+		Err: append([]string(nil), res.Err...),
+		Out: make([][]string, len(res.Out)),
+		img: res.img,
+		pdf: res.pdf,
+	}
+	for i, out := range res.Out {
+		c.Out[i] = append([]string(nil), out...)
+	}
+	if res.Blocked != nil {
+		c.Blocked = make(map[string]int, len(res.Blocked))
+		for k, v := range res.Blocked {
+			c.Blocked[k] = v
+		}
+	}
+	return c
+}
+
+func resultSize(res *Result) int64 {
+	size := int64(len(res.img) + len(res.pdf))
+	for _, s := range res.Err {
+		size += int64(len(s))
+	}
+	for _, out := range res.Out {
+		for _, s := range out {
+			size += int64(len(s))
+		}
+	}
+	return size
+}
+
+type lruEntry struct {
+	key    string
+	size   int64
+	stored time.Time
+	res    *Result
+}
+
+// An lru keeps track of cache entries in order of use. Entries expire ttl
+// after being stored, and the least recently used entries are evicted to keep
+// the total size within maxBytes. Zero means no limit for both.
+type lru struct {
+	ttl      time.Duration
+	maxBytes int64
+	evicted  func(e *lruEntry)
+	mu       sync.Mutex
+	entries  *list.List
+	index    map[string]*list.Element
+	size     int64
+}
+
+func newLRU(ttl time.Duration, maxBytes int64, evicted func(e *lruEntry)) *lru {
+	return &lru{
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		evicted:  evicted,
+		entries:  list.New(),
+		index:    make(map[string]*list.Element),
+	}
+}
+
+func (c *lru) get(key string) (lruEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.index[key]
+	if !ok {
+		return lruEntry{}, false
+	}
+	e := el.Value.(*lruEntry)
+	if c.ttl > 0 && time.Since(e.stored) > c.ttl {
+		c.remove(el)
+		return lruEntry{}, false
+	}
+	c.entries.MoveToFront(el)
+	return *e, true
+}
+
+// add inserts e as the most recently used entry. It reports false if e is
+// larger than the cache.
+func (c *lru) add(e *lruEntry) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.maxBytes > 0 && e.size > c.maxBytes {
+		return false
+	}
+	if el, ok := c.index[e.key]; ok {
+		c.size -= el.Value.(*lruEntry).size
+		c.entries.Remove(el)
+	}
+	c.index[e.key] = c.entries.PushFront(e)
+	c.size += e.size
+	for c.maxBytes > 0 && c.size > c.maxBytes {
+		c.remove(c.entries.Back())
+	}
+	return true
+}
+
+func (c *lru) remove(el *list.Element) {
+	e := el.Value.(*lruEntry)
+	c.entries.Remove(el)
+	delete(c.index, e.key)
+	c.size -= e.size
+	if c.evicted != nil {
+		c.evicted(e)
+	}
+}
+
+// A MemoryCache keeps results in memory.
+type MemoryCache struct {
+	lru *lru
+}
+
+// NewMemoryCache returns a cache whose results expire after ttl, and which
+// evicts the least recently used results beyond maxBytes of screenshots, PDFs
+// and output. Zero means no limit for both.
+func NewMemoryCache(ttl time.Duration, maxBytes int64) *MemoryCache {
+	return &MemoryCache{lru: newLRU(ttl, maxBytes, nil)}
+}
+
+func (c *MemoryCache) Get(key string) (*Result, bool) {
+	e, ok := c.lru.get(key)
+	return e.res, ok
+}
+
+func (c *MemoryCache) Put(key string, res *Result) {
+	c.lru.add(&lruEntry{key: key, size: resultSize(res), stored: time.Now(), res: res})
+}
+
+// A DiskCache keeps results in files in a directory, one per cache key. The
+// files left by an earlier process are reused.
+type DiskCache struct {
+	dir string
+	lru *lru
+}
+
+// storedResult is the on-disk encoding of a Result.
+type storedResult struct {
+	Blocked map[string]int
+	Err     []string
+	Out     [][]string
+	Img     []byte
+	PDF     []byte
+}
+
+// NewDiskCache returns a cache storing results in dir, with the same limits as
+// NewMemoryCache. maxBytes applies to the size of the files.
+func NewDiskCache(dir string, ttl time.Duration, maxBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	c := &DiskCache{dir: dir}
+	c.lru = newLRU(ttl, maxBytes, func(e *lruEntry) {
+		if err := os.Remove(c.path(e.key)); err != nil && !os.IsNotExist(err) {
+			Logger.Warn("Couldn't remove cached result", "key", e.key, "err", err)
+		}
+	})
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var stored []*lruEntry
+	for _, de := range entries {
+		if !de.Type().IsRegular() || !validCacheKey(de.Name()) {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		if ttl > 0 && time.Since(info.ModTime()) > ttl {
+			c.lru.evicted(&lruEntry{key: de.Name()})
+			continue
+		}
+		stored = append(stored, &lruEntry{key: de.Name(), size: info.Size(), stored: info.ModTime()})
+	}
+	// add the oldest files first, so that they are the first to be evicted
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].stored.Before(stored[j].stored)
+	})
+	for _, e := range stored {
+		if !c.lru.add(e) {
+			c.lru.evicted(e)
+		}
+	}
+	return c, nil
+}
+
+func (c *DiskCache) Get(key string) (*Result, bool) {
+	if _, ok := c.lru.get(key); !ok {
+		return nil, false
+	}
+	buf, err := os.ReadFile(c.path(key))
+	if err != nil {
+		// evicted after the lookup
+		return nil, false
+	}
+	var sr storedResult
+	if err = gob.NewDecoder(bytes.NewReader(buf)).Decode(&sr); err != nil {
+		Logger.Warn("Couldn't decode cached result", "key", key, "err", err)
+		return nil, false
+	}
+	res := &Result{
+		Blocked: sr.Blocked,
+		Err:     sr.Err,
+		Out:     sr.Out,
+		img:     sr.Img,
+		pdf:     sr.PDF,
+	}
+	return res, true
+}
+
+func (c *DiskCache) Put(key string, res *Result) {
+	var buf bytes.Buffer
+	sr := storedResult{
+		Blocked: res.Blocked,
+		Err:     res.Err,
+		Out:     res.Out,
+		Img:     res.img,
+		PDF:     res.pdf,
+	}
+	if err := gob.NewEncoder(&buf).Encode(&sr); err != nil {
+		Logger.Warn("Couldn't encode result for caching", "key", key, "err", err)
+		return
+	}
+	if c.lru.maxBytes > 0 && int64(buf.Len()) > c.lru.maxBytes {
+		return
+	}
+	if err := writeFileAtomic(c.path(key), buf.Bytes()); err != nil {
+		Logger.Warn("Couldn't cache result", "key", key, "err", err)
+		return
+	}
+	c.lru.add(&lruEntry{key: key, size: int64(buf.Len()), stored: time.Now()})
+}
+
+func (c *DiskCache) path(key string) string {
+	return filepath.Join(c.dir, key)
+}
+
+func validCacheKey(name string) bool {
+	if len(name) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place, so that readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,154 @@
+package decap
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const cacheTestQuery = `"query": [{"actions": [["navigate", "https://decap.test/"], ["eval", "1"]]}]`
+
+func TestCacheKey(t *testing.T) {
+	key := mustParse(t, `{"global_render_delay": "1s", `+cacheTestQuery+`}`).CacheKey()
+	same := []string{
+		`{"global_render_delay": "1000ms", "timeout": "20s", "retry_on_crash": true, ` + cacheTestQuery + `}`,
+		`{"global_render_delay": "1s", "reuse_window": true, ` + cacheTestQuery + `}`,
+	}
+	for _, body := range same {
+		if got := mustParse(t, body).CacheKey(); got != key {
+			t.Errorf("%s has a different cache key", body)
+		}
+	}
+	different := []string{
+		`{"global_render_delay": "2s", ` + cacheTestQuery + `}`,
+		`{"global_render_delay": "1s", "query": [{"actions": [["navigate", "https://decap.test/"], ["eval", "2"]]}]}`,
+		`{"global_render_delay": "1s", "extra_headers": {"X-A": "1"}, ` + cacheTestQuery + `}`,
+	}
+	for _, body := range different {
+		if got := mustParse(t, body).CacheKey(); got == key {
+			t.Errorf("%s has the same cache key", body)
+		}
+	}
+}
+
+func TestCacheable(t *testing.T) {
+	tests := []struct {
+		fields    string
+		cacheable bool
+	}{
+		{``, true},
+		{`"retry_on_crash": true,`, true},
+		{`"reuse_window": true,`, false},
+		{`"reuse_tab": true,`, false},
+		{`"sessionid": "0123abcd",`, false},
+		{`"storage_state": {"cookies": []},`, false},
+	}
+	for _, tt := range tests {
+		r := mustParse(t, `{"global_render_delay": "0s", `+tt.fields+cacheTestQuery+`}`)
+		if got := r.cacheable(); got != tt.cacheable {
+			t.Errorf("{%s}: cacheable = %t, want %t", tt.fields, got, tt.cacheable)
+		}
+	}
+}
+
+func outResult(s string) *Result {
+	return &Result{Err: []string{}, Out: [][]string{{s}}}
+}
+
+func TestMemoryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewMemoryCache(0, 10)
+	c.Put("a", outResult("aaaa"))
+	c.Put("b", outResult("bbbb"))
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("a is missing")
+	}
+	c.Put("c", outResult("cccc"))
+	if _, ok := c.Get("b"); ok {
+		t.Error("b wasn't evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+	c.Put("big", outResult("01234567890"))
+	if _, ok := c.Get("big"); ok {
+		t.Error("result larger than the cache was stored")
+	}
+}
+
+func TestMemoryCacheExpires(t *testing.T) {
+	c := NewMemoryCache(10*time.Millisecond, 0)
+	c.Put("a", outResult("a"))
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("a is missing")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := c.Get("a"); ok {
+		t.Error("a didn't expire")
+	}
+}
+
+func TestDiskCacheSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	key := mustParse(t, `{"global_render_delay": "0s", `+cacheTestQuery+`}`).CacheKey()
+	c, err := NewDiskCache(dir, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := outResult("out")
+	res.img = []byte("png")
+	res.Blocked = map[string]int{"ads": 2}
+	c.Put(key, res)
+	if err = os.WriteFile(filepath.Join(dir, "unrelated"), []byte("x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = NewDiskCache(dir, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := c.Get(key)
+	if !ok {
+		t.Fatal("cached result is missing after reopening the cache")
+	}
+	if got.Out[0][0] != "out" || string(got.img) != "png" || got.Blocked["ads"] != 2 {
+		t.Errorf("got %+v", got)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "unrelated")); err != nil {
+		t.Errorf("unrelated file: %s", err)
+	}
+}
+
+func TestExecuteCached(t *testing.T) {
+	defer func(c ResultCache) { Cache = c }(Cache)
+	Cache = NewMemoryCache(0, 0)
+	// executing fails fast, so the test needs no browser
+	defer func(tabs int, wait time.Duration) { MaxTabs, MaxQueueWait = tabs, wait }(MaxTabs, MaxQueueWait)
+	MaxTabs, MaxQueueWait = 1, 10*time.Millisecond
+	if !tabSlots.tryAcquire() {
+		t.Fatal("tab slot is taken")
+	}
+	defer tabSlots.release()
+
+	r := mustParse(t, `{"global_render_delay": "0s", `+cacheTestQuery+`}`)
+	Cache.Put(r.CacheKey(), outResult("cached"))
+
+	res, status, err := r.ExecuteCached(context.Background(), false, false)
+	if err != nil || status != CacheHit || res.Out[0][0] != "cached" {
+		t.Errorf("got %v, %s, %v, want the cached result", res, status, err)
+	}
+	_, status, err = r.ExecuteCached(context.Background(), true, false)
+	if status != CacheBypass || !errors.Is(err, ErrOverloaded) {
+		t.Errorf("no-cache: got %s, %v, want executing the request", status, err)
+	}
+
+	r = mustParse(t, `{"global_render_delay": "0s", "reuse_window": true, `+cacheTestQuery+`}`)
+	_, status, _ = r.ExecuteCached(context.Background(), false, false)
+	if status != CacheBypass {
+		t.Errorf("session request: status = %s, want %s", status, CacheBypass)
+	}
+}
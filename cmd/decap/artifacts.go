@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jobindex/decap"
+)
+
+var (
+	artifactStore = flag.String("artifact-store", "",
+		"where requests with artifact_url store screenshots and PDFs (file or s3; disabled if empty)")
+	artifactDir     = flag.String("artifact-dir", "", "directory of the file artifact store")
+	artifactBaseURL = flag.String("artifact-base-url", "",
+		"base URL of stored artifacts (file: defaults to decap's own artifacts endpoint; s3: presigned URLs are returned if empty)")
+	artifactCleanup = flag.Duration("artifact-cleanup-interval", 10*time.Minute,
+		"how often artifacts older than -artifact-retention are deleted")
+	s3Endpoint  = flag.String("s3-endpoint", "", "endpoint of the S3-compatible artifact store (e.g. http://minio:9000)")
+	s3Region    = flag.String("s3-region", "us-east-1", "region of the S3 artifact bucket")
+	s3Bucket    = flag.String("s3-bucket", "", "bucket of the S3 artifact store")
+	s3Prefix    = flag.String("s3-prefix", "", "key prefix of stored artifacts (e.g. decap/)")
+	s3URLExpiry = flag.Duration("s3-url-expiry", time.Hour, "how long presigned artifact URLs are valid (at most 7 days)")
+)
+
+func init() {
+	flag.DurationVar(&decap.ArtifactRetention, "artifact-retention", 0,
+		"how long stored artifacts are kept (0 keeps them forever)")
+}
+
+// setupArtifacts configures decap.Artifacts. The S3 credentials are read from
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, so that they don't show up in
+// the process list or the configuration log.
+func setupArtifacts() error {
+	switch *artifactStore {
+	case "":
+		return nil
+	case "file":
+		if *artifactDir == "" {
+			return fmt.Errorf("-artifact-dir is required by the file store")
+		}
+		baseURL := *artifactBaseURL
+		if baseURL == "" {
+			baseURL = artifactsPath
+		}
+		store, err := decap.NewFileStore(*artifactDir, baseURL)
+		if err != nil {
+			return err
+		}
+		decap.Artifacts = store
+	case "s3":
+		if *s3Endpoint == "" || *s3Bucket == "" {
+			return fmt.Errorf("-s3-endpoint and -s3-bucket are required by the s3 store")
+		}
+		store := &decap.S3Store{
+			Endpoint:  *s3Endpoint,
+			Region:    *s3Region,
+			Bucket:    *s3Bucket,
+			Prefix:    *s3Prefix,
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			PublicURL: *artifactBaseURL,
+			URLExpiry: *s3URLExpiry,
+		}
+		if store.AccessKey == "" || store.SecretKey == "" {
+			return fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for the s3 store")
+		}
+		decap.Artifacts = store
+	default:
+		return fmt.Errorf(`unknown store "%s" (expected file or s3)`, *artifactStore)
+	}
+	if decap.ArtifactRetention > 0 {
+		if *artifactCleanup <= 0 {
+			return fmt.Errorf("-artifact-cleanup-interval must be positive")
+		}
+		go decap.ExpireArtifacts(*artifactCleanup)
+	}
+	return nil
+}
+
+// artifactHandler serves the artifacts of a file store. Artifact names are
+// random, so the URLs are only known to the clients that requested them.
+func artifactHandler(w http.ResponseWriter, req *http.Request) {
+	store, ok := decap.Artifacts.(*decap.FileStore)
+	name := req.PathValue("name")
+	if !ok || !decap.ValidArtifactName(name) {
+		http.NotFound(w, req)
+		return
+	}
+	http.ServeFile(w, req, filepath.Join(store.Dir, name))
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// hmacMaxSkew is how far the timestamp of an HMAC-signed request may be
+	// from the server's clock.
+	hmacMaxSkew = 5 * time.Minute
+	// maxBodyBytes limits the body of authenticated requests, which is read
+	// into memory to check HMAC signatures before the client is known.
+	maxBodyBytes = 32 << 20
+)
+
+var errBodyTooLarge = fmt.Errorf("body is larger than %d bytes", maxBodyBytes)
+
+// A client is an API user configured in the clients file. It authenticates
+// either with "Authorization: Bearer <token>" or by signing requests with
+// "Authorization: HMAC <name>:<unix time>:<hex signature>", where the
+// signature is the HMAC-SHA256 of "<unix time>\n<method>\n<path>\n<body>".
+type client struct {
+	Name              string `json:"name"`
+	Token             string `json:"token"`
+	HMACSecret        string `json:"hmac_secret"`
+	MaxConcurrent     int    `json:"max_concurrent"`
+	RequestsPerMinute int    `json:"requests_per_minute"`
+	MaxTimeout        string `json:"max_timeout"`
+	MaxRenderDelay    string `json:"max_render_delay"`
+
+	maxTimeout     time.Duration
+	maxRenderDelay time.Duration
+	mu             sync.Mutex
+	running        int
+	tokens         float64
+	refilled       time.Time
+}
+
+type clientsConfig struct {
+	Clients []*client `json:"clients"`
+}
+
+type clientKey struct{}
+
+// clients is nil when authentication is disabled.
+var clients map[string]*client
+
+func loadClients(path string) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var conf clientsConfig
+	if err = json.Unmarshal(buf, &conf); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	clients = make(map[string]*client)
+	for i, c := range conf.Clients {
+		switch {
+		case c == nil || c.Name == "":
+			return fmt.Errorf("%s: clients[%d].name is empty or missing", path, i)
+		case c.Token == "" && c.HMACSecret == "":
+			return fmt.Errorf("%s: clients[%d]: either token or hmac_secret must be set", path, i)
+		case clients[c.Name] != nil:
+			return fmt.Errorf(`%s: clients[%d]: duplicate client "%s"`, path, i, c.Name)
+		}
+		if c.MaxTimeout != "" {
+			if c.maxTimeout, err = time.ParseDuration(c.MaxTimeout); err != nil {
+				return fmt.Errorf("%s: clients[%d].max_timeout: %s", path, i, err)
+			}
+		}
+		if c.MaxRenderDelay != "" {
+			if c.maxRenderDelay, err = time.ParseDuration(c.MaxRenderDelay); err != nil {
+				return fmt.Errorf("%s: clients[%d].max_render_delay: %s", path, i, err)
+			}
+		}
+		c.tokens = float64(c.RequestsPerMinute)
+		c.refilled = time.Now()
+		clients[c.Name] = c
+	}
+	return nil
+}
+
+// requireAuth rejects requests that don't authenticate as a configured
+// client. If quota is set, the client's request limits are enforced as well.
+func requireAuth(next http.Handler, quota bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if clients == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+		req.Body = http.MaxBytesReader(w, req.Body, maxBodyBytes)
+		c, err := authenticate(req)
+		if err == errBodyTooLarge {
+			status := http.StatusRequestEntityTooLarge
+			http.Error(w, fmt.Sprintf("%s: %s", http.StatusText(status), err), status)
+			return
+		}
+		if err != nil {
+			status := http.StatusUnauthorized
+			w.Header().Set("WWW-Authenticate", `Bearer realm="decap"`)
+			http.Error(w, fmt.Sprintf("%s: %s", http.StatusText(status), err), status)
+			return
+		}
+		if quota {
+			wait, ok := c.admit()
+			if !ok {
+				status := http.StatusTooManyRequests
+				w.Header().Set("Retry-After", retryAfter(wait))
+				msg := fmt.Sprintf("%s: client %s is over quota", http.StatusText(status), c.Name)
+				http.Error(w, msg, status)
+				return
+			}
+			defer c.done()
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), clientKey{}, c)))
+	})
+}
+
+func clientFromContext(ctx context.Context) *client {
+	c, _ := ctx.Value(clientKey{}).(*client)
+	return c
+}
+
+func authenticate(req *http.Request) (*client, error) {
+	scheme, credentials, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+	switch scheme {
+	case "Bearer":
+		for _, c := range clients {
+			if c.Token != "" && subtle.ConstantTimeCompare([]byte(c.Token), []byte(credentials)) == 1 {
+				return c, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid token")
+	case "HMAC":
+		return authenticateHMAC(req, credentials)
+	case "":
+		return nil, fmt.Errorf("missing Authorization header")
+	}
+	return nil, fmt.Errorf(`unsupported authorization scheme "%s"`, scheme)
+}
+
+func authenticateHMAC(req *http.Request, credentials string) (*client, error) {
+	parts := strings.Split(credentials, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("expected HMAC <client>:<timestamp>:<signature>")
+	}
+	c := clients[parts[0]]
+	if c == nil || c.HMACSecret == "" {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	ts, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp")
+	}
+	if skew := time.Since(time.Unix(ts, 0)); skew > hmacMaxSkew || skew < -hmacMaxSkew {
+		return nil, fmt.Errorf("timestamp is too far from the server's clock")
+	}
+	sig, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	body, err := io.ReadAll(req.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, errBodyTooLarge
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read body: %s", err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	mac := hmac.New(sha256.New, []byte(c.HMACSecret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", parts[1], req.Method, req.URL.Path)
+	mac.Write(body)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	return c, nil
+}
+
+// admit takes a concurrency slot and a rate limit token for a request. If the
+// client is over quota, it reports how long to wait before trying again.
+func (c *client) admit() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.MaxConcurrent > 0 && c.running >= c.MaxConcurrent {
+		return time.Second, false
+	}
+	if c.RequestsPerMinute > 0 {
+		perToken := time.Minute / time.Duration(c.RequestsPerMinute)
+		now := time.Now()
+		c.tokens += float64(now.Sub(c.refilled)) / float64(perToken)
+		c.tokens = min(c.tokens, float64(c.RequestsPerMinute))
+		c.refilled = now
+		if c.tokens < 1 {
+			return time.Duration((1 - c.tokens) * float64(perToken)), false
+		}
+		c.tokens--
+	}
+	c.running++
+	return 0, true
+}
+
+func (c *client) done() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running--
+}
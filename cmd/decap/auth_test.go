@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func withClients(t *testing.T, cs ...*client) {
+	t.Helper()
+	old := clients
+	clients = make(map[string]*client)
+	for _, c := range cs {
+		clients[c.Name] = c
+	}
+	t.Cleanup(func() { clients = old })
+}
+
+func signedRequest(c *client, body []byte) *http.Request {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req := httptest.NewRequest("POST", newBrowsePath, bytes.NewReader(body))
+	mac := hmac.New(sha256.New, []byte(c.HMACSecret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", ts, req.Method, req.URL.Path)
+	mac.Write(body)
+	req.Header.Set("Authorization", fmt.Sprintf("HMAC %s:%s:%s", c.Name, ts, hex.EncodeToString(mac.Sum(nil))))
+	return req
+}
+
+// echoClient replies with the name of the authenticated client and the body.
+var echoClient = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	fmt.Fprintf(w, "%s %s", owner(req), body)
+})
+
+func TestRequireAuthHMAC(t *testing.T) {
+	c := &client{Name: "alice", HMACSecret: "secret"}
+	withClients(t, c)
+	h := requireAuth(echoClient, false)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, signedRequest(c, []byte(`{"query": []}`)))
+	if rec.Code != http.StatusOK || rec.Body.String() != `alice {"query": []}` {
+		t.Errorf("signed request: %d %q", rec.Code, rec.Body)
+	}
+
+	req := signedRequest(c, []byte(`{"query": []}`))
+	req.Body = io.NopCloser(bytes.NewReader([]byte(`{"query": [1]}`)))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("tampered body: status = %d, want 401", rec.Code)
+	}
+}
+
+func TestRequireAuthLimitsBody(t *testing.T) {
+	c := &client{Name: "alice", HMACSecret: "secret"}
+	withClients(t, c)
+	h := requireAuth(echoClient, false)
+
+	req := signedRequest(c, make([]byte, maxBodyBytes+1))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want 413", rec.Code)
+	}
+}
+
+func TestRequireAuthBearer(t *testing.T) {
+	withClients(t, &client{Name: "bob", Token: "t0ken"})
+	h := requireAuth(echoClient, false)
+	for token, want := range map[string]int{"t0ken": http.StatusOK, "wrong": http.StatusUnauthorized} {
+		req := httptest.NewRequest("GET", sessionsPath, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("token %s: status = %d, want %d", token, rec.Code, want)
+		}
+	}
+}
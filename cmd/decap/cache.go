@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jobindex/decap"
+)
+
+func setupCache() error {
+	maxBytes := int64(*cacheMaxMB) << 20
+	switch *cacheBackend {
+	case "":
+	case "memory":
+		decap.Cache = decap.NewMemoryCache(*cacheTTL, maxBytes)
+	case "disk":
+		if *cacheDir == "" {
+			return fmt.Errorf("-cache-dir is required by the disk cache")
+		}
+		c, err := decap.NewDiskCache(*cacheDir, *cacheTTL, maxBytes)
+		if err != nil {
+			return err
+		}
+		decap.Cache = c
+	default:
+		return fmt.Errorf(`unknown backend "%s" (expected memory or disk)`, *cacheBackend)
+	}
+	return nil
+}
+
+// cacheControl reports whether the client asked for a fresh result with
+// Cache-Control: no-cache, and whether it asked not to have the result cached
+// with no-store.
+func cacheControl(req *http.Request) (noCache, noStore bool) {
+	for _, v := range req.Header.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			switch strings.ToLower(strings.TrimSpace(directive)) {
+			case "no-cache":
+				noCache = true
+			case "no-store":
+				noStore = true
+			}
+		}
+	}
+	if !noCache && req.Header.Get("Pragma") == "no-cache" {
+		noCache = true
+	}
+	return noCache, noStore
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configFile is the YAML file of default flag values. Its keys are flag
+// names, e.g. "max-tabs: 4".
+var configFile = flag.String("config", "",
+	"YAML file with flag values; environment variables (DECAP_MAX_TABS etc.) and flags take precedence")
+
+// configSources records where the value of each flag came from.
+var configSources = make(map[string]string)
+
+// loadConfig layers the settings, in increasing order of precedence: flag
+// defaults, the config file, DECAP_* environment variables and the command
+// line. It must be called after flag.Parse.
+func loadConfig() error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+		configSources[f.Name] = "flag"
+	})
+
+	path := *configFile
+	if !explicit["config"] {
+		if env := os.Getenv(envName("config")); env != "" {
+			path = env
+		}
+	}
+	if path != "" {
+		values, err := readConfigFile(path)
+		if err != nil {
+			return err
+		}
+		for name, value := range values {
+			if explicit[name] {
+				continue
+			}
+			if err = flag.Set(name, value); err != nil {
+				return fmt.Errorf("%s: %s: %s", path, name, err)
+			}
+			configSources[name] = "file"
+		}
+	}
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok || explicit[f.Name] || err != nil {
+			return
+		}
+		if err = flag.Set(f.Name, value); err != nil {
+			err = fmt.Errorf("%s: %s", envName(f.Name), err)
+			return
+		}
+		configSources[f.Name] = "env"
+	})
+	if err != nil {
+		return err
+	}
+	return checkDurations()
+}
+
+// positiveDurations are the duration settings that can't be zero, e.g.
+// because they are ticker intervals.
+var positiveDurations = map[string]bool{
+	"gc-interval":     true,
+	"window-timeout":  true,
+	"default-timeout": true,
+	"max-timeout":     true,
+	"ready-timeout":   true,
+	"cache-ttl":       true,
+	"s3-url-expiry":   true,
+}
+
+// checkDurations rejects negative durations, and zero for positiveDurations.
+func checkDurations() error {
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		getter, ok := f.Value.(flag.Getter)
+		if !ok || err != nil {
+			return
+		}
+		d, ok := getter.Get().(time.Duration)
+		switch {
+		case !ok:
+		case d < 0:
+			err = fmt.Errorf("%s can't be negative", f.Name)
+		case d == 0 && positiveDurations[f.Name]:
+			err = fmt.Errorf("%s must be positive", f.Name)
+		}
+	})
+	return err
+}
+
+func readConfigFile(path string) (map[string]string, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	if err = yaml.Unmarshal(buf, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	values := make(map[string]string)
+	for key, v := range raw {
+		name := strings.ReplaceAll(key, "_", "-")
+		if flag.Lookup(name) == nil || name == "config" {
+			return nil, fmt.Errorf(`%s: unknown setting "%s"`, path, key)
+		}
+		switch v := v.(type) {
+		case nil:
+			values[name] = ""
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[name] = strings.Join(items, ",")
+		case map[string]interface{}:
+			return nil, fmt.Errorf(`%s: setting "%s" can't be a mapping`, path, key)
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
+
+func envName(flagName string) string {
+	return "DECAP_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// logConfig logs the effective value of every setting and where it came
+// from.
+func logConfig() {
+	var names []string
+	flag.VisitAll(func(f *flag.Flag) { names = append(names, f.Name) })
+	sort.Strings(names)
+	attrs := make([]any, 0, len(names))
+	for _, name := range names {
+		source := configSources[name]
+		if source == "" {
+			source = "default"
+		}
+		value := flag.Lookup(name).Value.String()
+		attrs = append(attrs, slog.String(name, fmt.Sprintf("%s (%s)", value, source)))
+	}
+	slog.Info("Effective configuration", attrs...)
+}
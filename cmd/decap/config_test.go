@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setFlag sets a flag for the duration of the test.
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	old := flag.Lookup(name).Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { flag.Set(name, old) })
+}
+
+func TestCheckDurations(t *testing.T) {
+	tests := []struct {
+		flag  string
+		value string
+		err   string
+	}{
+		{"gc-interval", "0s", "gc-interval must be positive"},
+		{"window-timeout", "0s", "window-timeout must be positive"},
+		{"max-queue-wait", "-1s", "max-queue-wait can't be negative"},
+		{"max-queue-wait", "0s", ""},
+		{"shutdown-delay", "0s", ""},
+		{"gc-interval", "30s", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.flag+"="+tt.value, func(t *testing.T) {
+			setFlag(t, tt.flag, tt.value)
+			err := checkDurations()
+			if tt.err == "" && err != nil {
+				t.Errorf("err = %s, want nil", err)
+			}
+			if tt.err != "" && (err == nil || err.Error() != tt.err) {
+				t.Errorf("err = %v, want %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decap.yaml")
+	conf := "max_tabs: 4\nallow-hosts: [a.test, b.test]\ngc-interval: 1m\nlog-level:\n"
+	if err := os.WriteFile(path, []byte(conf), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	values, err := readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"max-tabs":    "4",
+		"allow-hosts": "a.test,b.test",
+		"gc-interval": "1m",
+		"log-level":   "",
+	}
+	if len(values) != len(want) {
+		t.Errorf("values = %v, want %v", values, want)
+	}
+	for k, v := range want {
+		if values[k] != v {
+			t.Errorf("%s = %q, want %q", k, values[k], v)
+		}
+	}
+
+	for _, bad := range []string{"no-such-flag: 1\n", "config: other.yaml\n", "max-tabs: {a: 1}\n"} {
+		if err := os.WriteFile(path, []byte(bad), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readConfigFile(path); err == nil || !strings.Contains(err.Error(), path) {
+			t.Errorf("%q: err = %v, want an error naming the file", bad, err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"path"
+	"strings"
+)
+
+var (
+	corsOrigins = flag.String("cors-origins", "",
+		`comma-separated origins allowed to call the API from browsers ("*" allows any)`)
+	corsHeaders = flag.String("cors-headers", "Authorization, Content-Type, X-Request-ID",
+		"request headers allowed in cross-origin requests")
+	corsMethods = flag.String("cors-methods", "GET, POST, DELETE",
+		"methods allowed in cross-origin requests")
+)
+
+// corsExposedHeaders are the response headers that cross-origin callers may
+// read.
+const corsExposedHeaders = "Retry-After, X-Request-ID"
+
+// allowCORS adds CORS headers to the response if the request comes from an
+// allowed origin. It answers preflight (OPTIONS) requests itself and reports
+// whether it did so. Every response varies by Origin, so that caches don't
+// serve a response without CORS headers to an allowed origin, or vice versa.
+func allowCORS(w http.ResponseWriter, req *http.Request) bool {
+	w.Header().Add("Vary", "Origin")
+	origin := req.Header.Get("Origin")
+	allowed := ""
+	for _, o := range splitList(*corsOrigins) {
+		if o == "*" || o == origin {
+			allowed = o
+			break
+		}
+	}
+	if origin != "" && allowed != "" {
+		w.Header().Set("Access-Control-Allow-Origin", allowed)
+		w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+	}
+	if req.Method != http.MethodOptions {
+		return false
+	}
+	if origin != "" && allowed != "" {
+		w.Header().Set("Access-Control-Allow-Methods", *corsMethods)
+		w.Header().Set("Access-Control-Allow-Headers", *corsHeaders)
+		w.Header().Set("Access-Control-Max-Age", "600")
+	}
+	w.Header().Set("Allow", "OPTIONS, "+*corsMethods)
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if allowCORS(w, req) {
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// cleanPaths cleans request paths (e.g. "/api/browse//v0.8/") in place
+// instead of letting http.ServeMux redirect them, since clients turn a
+// redirected POST into a GET.
+func cleanPaths(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p := req.URL.Path
+		if p == "" || p[0] != '/' {
+			p = "/" + p
+		}
+		clean := path.Clean(p)
+		if strings.HasSuffix(p, "/") && clean != "/" {
+			clean += "/"
+		}
+		if clean != req.URL.Path {
+			req.URL.Path = clean
+			req.URL.RawPath = ""
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSVariesByOrigin(t *testing.T) {
+	old := *corsOrigins
+	*corsOrigins = "https://allowed.test"
+	t.Cleanup(func() { *corsOrigins = old })
+
+	h := withCORS(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	for _, origin := range []string{"", "https://allowed.test", "https://other.test"} {
+		for _, method := range []string{"GET", "OPTIONS"} {
+			req := httptest.NewRequest(method, sessionsPath, nil)
+			if origin != "" {
+				req.Header.Set("Origin", origin)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if got := rec.Header().Values("Vary"); len(got) != 1 || got[0] != "Origin" {
+				t.Errorf("%s from %q: Vary = %q, want Origin", method, origin, got)
+			}
+			allowed := rec.Header().Get("Access-Control-Allow-Origin")
+			if want := origin == "https://allowed.test"; (allowed != "") != want {
+				t.Errorf("%s from %q: Access-Control-Allow-Origin = %q", method, origin, allowed)
+			}
+		}
+	}
+}
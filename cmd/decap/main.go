@@ -1,21 +1,42 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/jobindex/decap"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
 )
 
 const (
+	artifactsPath = "/api/decap/v0/artifacts"
 	browsePath    = "/api/browse/"
 	newBrowsePath = "/api/decap/v0/browse"
+	healthPath    = "/healthz"
+	metricsPath   = "/metrics"
+	readyPath     = "/readyz"
+	statusPath    = "/status"
+	sessionsPath  = "/api/decap/v0/sessions"
+	statsPath     = "/api/decap/v0/stats"
+	tabsPath      = "/api/decap/v0/tabs"
 	DefaultPort   = 4531
 	minAPI        = "v0.8"
 	nextAPI       = "v0.9"
@@ -24,25 +45,170 @@ const (
 var (
 	deprecatedAPIs []string
 	debugMode      = false
+	listenAddr     string
+	tlsCert        = flag.String("tls-cert", "", "TLS certificate file (serves HTTPS together with -tls-key)")
+	tlsKey         = flag.String("tls-key", "", "TLS private key file")
+	filterListDir  = flag.String("filter-lists", "", "directory of EasyList-format filter lists (*.txt)")
+	remoteBrowser  = flag.String("remote-browser", "",
+		"comma-separated DevTools websocket URLs of running browsers to use instead of launching Chrome")
+	browserConfig = flag.String("browser-config", "",
+		"JSON file with the default and named Chrome launch profiles")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 30*time.Second,
+		"how long to let running queries finish after SIGTERM or SIGINT")
+	shutdownDelay = flag.Duration("shutdown-delay", 0,
+		"how long to keep serving as unready after SIGTERM or SIGINT before draining, so load balancers can react")
+	readyTimeout = flag.Duration("ready-timeout", 5*time.Second,
+		"deadline for opening a tab and evaluating JavaScript when probing readiness")
+	logLevel     = flag.String("log-level", "info", "minimum log level (debug, info, warn or error)")
+	logFormat    = flag.String("log-format", "text", "log format (text or json)")
+	allowSchemes = flag.String("allow-schemes", "http,https",
+		"comma-separated URL schemes that navigate accepts (empty allows any)")
+	allowHosts = flag.String("allow-hosts", "",
+		"comma-separated host globs (e.g. *.example.com) that requests may load from; other hosts are denied")
+	denyHosts = flag.String("deny-hosts", "",
+		"comma-separated host globs that requests may not load from")
+	clientsFile = flag.String("clients", "",
+		"JSON file of API clients with tokens and quotas (authentication is disabled if empty)")
+	otlpEndpoint = flag.String("otlp-endpoint", "",
+		"OTLP/HTTP endpoint to export traces to (e.g. http://collector:4318)")
+	cacheBackend = flag.String("cache", "", "result cache backend (memory or disk; disabled if empty)")
+	cacheDir     = flag.String("cache-dir", "", "directory of the disk result cache")
+	cacheTTL     = flag.Duration("cache-ttl", 10*time.Minute, "how long cached results are served")
+	cacheMaxMB   = flag.Int("cache-max-mb", 256, "maximum size of the result cache in MiB (0 means no limit)")
+	launch       decap.LaunchProfile
+	draining     atomic.Bool
 )
 
 func init() {
 	deprecatedAPIs = inferDeprecatedAPIs()
 	debugMode = os.Getenv("DEBUG") == "true"
+
+	defaultListen := fmt.Sprintf(":%d", DefaultPort)
+	if debugMode {
+		defaultListen = fmt.Sprintf(":%d", autoDebuggingPort())
+	}
+	flag.StringVar(&listenAddr, "listen", defaultListen, "address to listen on")
+	flag.DurationVar(&decap.MaxTimeout, "max-timeout", decap.MaxTimeout,
+		"maximum timeout of a request")
+	flag.DurationVar(&decap.MaxRenderDelay, "max-render-delay", decap.MaxRenderDelay,
+		"maximum global_render_delay of a request")
+	flag.DurationVar(&decap.DefaultTimeout, "default-timeout", decap.DefaultTimeout,
+		"timeout of requests that don't set one")
+	flag.DurationVar(&decap.WindowTimeout, "window-timeout", decap.WindowTimeout,
+		"how long an idle window session is kept open")
+	flag.DurationVar(&decap.GCInterval, "gc-interval", decap.GCInterval,
+		"how often idle windows are closed")
+	flag.BoolVar(&decap.ProcessPerWindow, "process-per-window", false,
+		"run each window session in its own Chrome process instead of an incognito browser context")
+	flag.IntVar(&decap.BrowserPoolSize, "browser-pool", decap.BrowserPoolSize,
+		"number of shared Chrome processes to spread window sessions across")
+	flag.StringVar(&launch.ExecPath, "chrome-path", "", "path of the Chrome binary")
+	flag.BoolVar(&launch.DisableGPU, "disable-gpu", false, "launch Chrome with --disable-gpu")
+	flag.BoolVar(&launch.NoSandbox, "no-sandbox", false, "launch Chrome with --no-sandbox")
+	flag.StringVar(&launch.ProxyServer, "proxy-server", "", "proxy server for Chrome (e.g. socks5://host:1080)")
+	flag.StringVar(&launch.Lang, "lang", "", "language of the Chrome UI and Accept-Language (e.g. da-DK)")
+	flag.StringVar(&launch.UserDataDir, "user-data-dir", "", "Chrome user data directory")
+	flag.Func("window-size", "Chrome window size as WIDTHxHEIGHT", func(v string) error {
+		var width, height int
+		if _, err := fmt.Sscanf(v, "%dx%d", &width, &height); err != nil {
+			return fmt.Errorf("expected WIDTHxHEIGHT")
+		}
+		launch.WindowSize = []int{width, height}
+		return nil
+	})
+	flag.StringVar(&decap.ProfileDir, "profile-dir", "",
+		"directory of the user data directories of persistent profiles (disabled if empty)")
+	flag.BoolVar(&decap.Policy.BlockPrivate, "block-private-ips", false,
+		"deny navigation and requests to hosts that resolve to private, loopback or link-local addresses")
+	flag.IntVar(&decap.WarmTabs, "warm-tabs", 0,
+		"number of blank tabs per browser kept ready for requests without window sessions")
+	flag.IntVar(&decap.MaxWindows, "max-windows", 0,
+		"maximum number of open window sessions (0 means no limit)")
+	flag.IntVar(&decap.MaxTabs, "max-tabs", 0,
+		"maximum number of concurrently executing tabs (0 means no limit)")
+	flag.DurationVar(&decap.MaxQueueWait, "max-queue-wait", decap.MaxQueueWait,
+		"how long a request may wait for a free window or tab")
 }
 
 func main() {
 	flag.Parse()
+	if err := loadConfig(); err != nil {
+		log.Fatalf("loading configuration: %s", err)
+	}
+
+	logger, err := newLogger(*logLevel, *logFormat)
+	if err != nil {
+		log.Fatalf("configuring logging: %s", err)
+	}
+	decap.Logger = logger
+	slog.SetDefault(logger)
+
+	logConfig()
+
+	shutdownTracing, err := setupTracing(*otlpEndpoint)
+	if err != nil {
+		log.Fatalf("configuring tracing: %s", err)
+	}
+
+	decap.RemoteBrowsers = splitList(*remoteBrowser)
+	if decap.ProcessPerWindow && len(decap.RemoteBrowsers) > 0 {
+		log.Fatal("-process-per-window can't be used with -remote-browser")
+	}
+	if *browserConfig != "" {
+		if err := decap.LoadLaunchConfig(*browserConfig); err != nil {
+			log.Fatalf("loading browser config: %s", err)
+		}
+	}
+	applyLaunchFlags(&decap.Launch.Default)
+	if decap.ProcessPerWindow {
+		// every window would launch Chrome on the directory, which Chrome locks
+		if decap.Launch.Default.UserDataDir != "" {
+			log.Fatal("-process-per-window can't be used with a user data directory")
+		}
+		for name, p := range decap.Launch.Profiles {
+			if p.UserDataDir != "" {
+				log.Fatalf(`-process-per-window can't be used with browser profile "%s", which has a user data directory`, name)
+			}
+		}
+	}
+	decap.Policy.Schemes = splitList(*allowSchemes)
+	decap.Policy.AllowHosts = splitList(*allowHosts)
+	decap.Policy.DenyHosts = splitList(*denyHosts)
+	if err := decap.Policy.Validate(); err != nil {
+		log.Fatalf("URL policy: %s", err)
+	}
+	if decap.ProfileDir != "" {
+		if err := os.MkdirAll(decap.ProfileDir, 0o700); err != nil {
+			log.Fatalf("creating profile directory: %s", err)
+		}
+	}
+	if *clientsFile != "" {
+		if err := loadClients(*clientsFile); err != nil {
+			log.Fatalf("loading clients: %s", err)
+		}
+	}
+	if *filterListDir != "" {
+		if err := decap.LoadFilterLists(*filterListDir); err != nil {
+			log.Fatalf("loading filter lists: %s", err)
+		}
+	}
+	if err := setupCache(); err != nil {
+		log.Fatalf("configuring result cache: %s", err)
+	}
+	if err := setupArtifacts(); err != nil {
+		log.Fatalf("configuring artifact store: %s", err)
+	}
 
 	go decap.AllocateSessions()
+	prometheus.MustRegister(decap.StateCollector{})
 
 	var handler http.Handler
 	http.HandleFunc("/", http.NotFound)
 
-	handler = handleHTTPMethod(http.HandlerFunc(oldVersionFmtBrowseHandler))
+	handler = handleHTTPMethod(requireAuth(http.HandlerFunc(oldVersionFmtBrowseHandler), true))
 	http.Handle(browsePath, handler)
 
-	handler = handleHTTPMethod(http.HandlerFunc(browseHandler))
+	handler = handleHTTPMethod(requireAuth(http.HandlerFunc(browseHandler), true))
 	http.Handle(newBrowsePath, handler)
 
 	handler = handleHTTPMethod(http.HandlerFunc(deprecationHandler))
@@ -50,16 +216,83 @@ func main() {
 		http.Handle(fmt.Sprintf("%s%s/", browsePath, v), handler)
 	}
 
-	var port int
-	if debugMode {
-		port = autoDebuggingPort()
+	http.Handle("GET "+sessionsPath, withCORS(requireAuth(http.HandlerFunc(sessionsHandler), false)))
+	http.Handle("GET "+sessionsPath+"/{id}", withCORS(requireAuth(http.HandlerFunc(sessionHandler), false)))
+	http.Handle("DELETE "+sessionsPath+"/{id}", withCORS(requireAuth(http.HandlerFunc(closeSessionHandler), false)))
+	http.Handle("DELETE "+tabsPath+"/{id}", withCORS(requireAuth(http.HandlerFunc(closeTabHandler), false)))
+	http.Handle("GET "+statsPath, withCORS(requireAuth(http.HandlerFunc(statsHandler), false)))
+	http.Handle("GET "+artifactsPath+"/{name}", withCORS(http.HandlerFunc(artifactHandler)))
+	for _, p := range []string{sessionsPath, sessionsPath + "/{id}", tabsPath + "/{id}", statsPath, artifactsPath + "/{name}"} {
+		http.Handle("OPTIONS "+p, withCORS(http.NotFoundHandler()))
+	}
+	http.HandleFunc("GET "+healthPath, healthHandler)
+	http.HandleFunc("GET "+readyPath, readyHandler)
+	http.Handle("GET "+statusPath, requireAuth(http.HandlerFunc(statusHandler), false))
+	http.Handle("GET "+metricsPath, promhttp.Handler())
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("-tls-cert and -tls-key must be given together")
+	}
+
+	srv := &http.Server{Addr: listenAddr, Handler: cleanPaths(http.DefaultServeMux)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+		slog.Info("Caught signal, draining queries", "signal", (<-sig).String())
+		drain(srv)
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Warn("Couldn't flush traces", "err", err)
+		}
+	}()
+
+	scheme := "http"
+	if *tlsCert != "" {
+		scheme = "https"
+	}
+	base, err := listenURL(scheme, listenAddr)
+	if err != nil {
+		log.Fatalf("Invalid -listen address: %s", err)
+	}
+	slog.Info("decap listening on " + base + newBrowsePath)
+	if *tlsCert != "" {
+		err = srv.ListenAndServeTLS(*tlsCert, *tlsKey)
 	} else {
-		port = DefaultPort
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+}
+
+// listenURL returns the base URL of the server listening on addr, which may be
+// an IPv6 address such as "[::1]:4531" or leave out the host.
+func listenURL(scheme, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
 	}
+	if host == "" {
+		host = "localhost"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port), nil
+}
 
-	fmt.Fprintf(os.Stderr, "%s decap listening on http://localhost:%d%s\n",
-		time.Now().Format("[15:04:05]"), port, newBrowsePath)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+// drain reports unready for shutdownDelay, then stops accepting requests,
+// waits up to shutdownTimeout for running queries to finish, and finally
+// closes all browsers.
+func drain(srv *http.Server) {
+	draining.Store(true)
+	time.Sleep(*shutdownDelay)
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Warn("Giving up on running queries", "err", err)
+	}
+	n := decap.Shutdown()
+	slog.Info("Closed windows, exiting", "windows", n)
 }
 
 func oldVersionFmtBrowseHandler(w http.ResponseWriter, req *http.Request) {
@@ -94,7 +327,16 @@ func browseHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	ctx, span := traceRequest(req, "browse")
+	defer span.End()
+
 	var dec decap.Request
+	dec.SetID(requestID(req))
+	if c := clientFromContext(req.Context()); c != nil {
+		dec.SetLimits(c.maxTimeout, c.maxRenderDelay)
+		dec.SetOwner(c.Name)
+	}
+	w.Header().Set("X-Request-ID", dec.ID())
 	err := dec.ParseRequest(req.Body)
 	if err != nil {
 		status := http.StatusBadRequest
@@ -107,7 +349,25 @@ func browseHandler(w http.ResponseWriter, req *http.Request) {
 
 	err_status := http.StatusInternalServerError
 	var res *decap.Result
-	res, err = dec.Execute()
+	var cacheStatus string
+	noCache, noStore := cacheControl(req)
+	res, cacheStatus, err = dec.ExecuteCached(ctx, noCache, noStore)
+	if cacheStatus != "" {
+		w.Header().Set("X-Decap-Cache", cacheStatus)
+	}
+	if errors.Is(err, decap.ErrOverloaded) || errors.Is(err, decap.ErrShutdown) {
+		status := http.StatusServiceUnavailable
+		w.Header().Set("Retry-After", retryAfter(decap.MaxQueueWait))
+		msg := fmt.Sprintf("%s: %s", http.StatusText(status), err)
+		http.Error(w, msg, status)
+		return
+	}
+	if errors.Is(err, decap.ErrBrowserCrashed) {
+		status := http.StatusBadGateway
+		msg := fmt.Sprintf("%s: %s", http.StatusText(status), err)
+		http.Error(w, msg, status)
+		return
+	}
 	if err != nil {
 		// TODO: Propagate HTTP status properly
 		msg := fmt.Sprintf("%s: %s", http.StatusText(err_status), err)
@@ -116,6 +376,8 @@ func browseHandler(w http.ResponseWriter, req *http.Request) {
 	}
 
 	// send response body
+	_, encodeSpan := otel.Tracer(tracerName).Start(ctx, "encode")
+	defer encodeSpan.End()
 	switch res.Type() {
 	case "json":
 		w.Header().Set("Content-Type", "application/json")
@@ -144,7 +406,7 @@ func browseHandler(w http.ResponseWriter, req *http.Request) {
 		}
 		return
 	default:
-		fmt.Fprintf(os.Stderr, `unknown results type "%s"`, res.Type())
+		slog.Error("Unknown result type", "request_id", dec.ID(), "type", res.Type())
 		msg := fmt.Sprintf(`%s: Unknown result type "%s"`,
 			http.StatusText(err_status), res.Type())
 		http.Error(w, msg, err_status)
@@ -152,6 +414,54 @@ func browseHandler(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func healthHandler(w http.ResponseWriter, req *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func readyHandler(w http.ResponseWriter, req *http.Request) {
+	status := http.StatusServiceUnavailable
+	if draining.Load() {
+		http.Error(w, fmt.Sprintf("%s: draining", http.StatusText(status)), status)
+		return
+	}
+	if err := probe(); err != nil {
+		http.Error(w, fmt.Sprintf("%s: %s", http.StatusText(status), err), status)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// readyProbeInterval is how long the result of a readiness probe is served
+// from readyProbe, since /readyz is unauthenticated and every probe opens a
+// tab.
+const readyProbeInterval = 5 * time.Second
+
+var readyProbe struct {
+	sync.Mutex
+	err  error
+	last time.Time
+}
+
+// probe runs decap.Probe at most once per readyProbeInterval and returns the
+// latest result. Concurrent callers wait for the running probe.
+func probe() error {
+	readyProbe.Lock()
+	defer readyProbe.Unlock()
+	if time.Since(readyProbe.last) >= readyProbeInterval {
+		readyProbe.err = decap.Probe(*readyTimeout)
+		readyProbe.last = time.Now()
+	}
+	return readyProbe.err
+}
+
+func statusHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, decap.CurrentStatus())
+}
+
+func statsHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, decap.CurrentStats())
+}
+
 func deprecationHandler(w http.ResponseWriter, req *http.Request) {
 	version, _ := versionFromPath(req.URL.Path)
 	status := http.StatusGone
@@ -169,11 +479,9 @@ func versionFromPath(path string) (string, error) {
 
 func handleHTTPMethod(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-
-		// TODO: Handle OPTIONS
-
-		// TODO: Handle 301 redirects correctly (e.g. "/api/browse//")
-
+		if allowCORS(w, req) {
+			return
+		}
 		if req.Method != http.MethodPost {
 			status := http.StatusMethodNotAllowed
 			msg := fmt.Sprintf("%s: %s", http.StatusText(status), req.Method)
@@ -202,6 +510,72 @@ func inferDeprecatedAPIs() []string {
 	return deprecated
 }
 
+// applyLaunchFlags overrides the launch profile p with the Chrome flags given
+// on the command line.
+func applyLaunchFlags(p *decap.LaunchProfile) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "chrome-path":
+			p.ExecPath = launch.ExecPath
+		case "disable-gpu":
+			p.DisableGPU = launch.DisableGPU
+		case "no-sandbox":
+			p.NoSandbox = launch.NoSandbox
+		case "proxy-server":
+			p.ProxyServer = launch.ProxyServer
+		case "lang":
+			p.Lang = launch.Lang
+		case "user-data-dir":
+			p.UserDataDir = launch.UserDataDir
+		case "window-size":
+			p.WindowSize = launch.WindowSize
+		}
+	})
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// requestID returns the request's X-Request-ID header, or a new ID if the
+// header is missing or unreasonable.
+func requestID(req *http.Request) string {
+	id := req.Header.Get("X-Request-ID")
+	if id == "" || len(id) > 128 || strings.ContainsFunc(id, func(r rune) bool {
+		return r < 0x21 || r > 0x7e
+	}) {
+		return decap.NewRequestID()
+	}
+	return id
+}
+
+func newLogger(level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("-log-level: %s", err)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return nil, fmt.Errorf(`-log-format: unknown format "%s"`, format)
+}
+
+// retryAfter formats d as a Retry-After header value in whole seconds.
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(d.Seconds()))))
+}
+
 func autoDebuggingPort() int {
 	return DefaultPort - DefaultPort%1000 + 100 + os.Getuid()%100
 }
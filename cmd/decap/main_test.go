@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestListenURL(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{":4531", "http://localhost:4531"},
+		{"0.0.0.0:4531", "http://0.0.0.0:4531"},
+		{"[::1]:4531", "http://[::1]:4531"},
+		{"[::]:4531", "http://[::]:4531"},
+	}
+	for _, tt := range tests {
+		got, err := listenURL("http", tt.addr)
+		if err != nil || got != tt.want {
+			t.Errorf("listenURL(%q) = %q, %v, want %q", tt.addr, got, err, tt.want)
+		}
+	}
+	if _, err := listenURL("http", "::1"); err == nil {
+		t.Error("listenURL accepted an address without a port")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/jobindex/decap"
+)
+
+// owner returns the name of the client that authenticated req, which owns the
+// window sessions and tabs its requests create, or "" if authentication is
+// disabled.
+func owner(req *http.Request) string {
+	if c := clientFromContext(req.Context()); c != nil {
+		return c.Name
+	}
+	return ""
+}
+
+// ownedWindow returns the window session with the given ID if the client
+// owns it.
+func ownedWindow(req *http.Request, id string) (decap.WindowInfo, bool) {
+	window, ok := decap.LookupWindow(id)
+	return window, ok && window.Owner == owner(req)
+}
+
+func sessionsHandler(w http.ResponseWriter, req *http.Request) {
+	windows := make([]decap.WindowInfo, 0)
+	for _, window := range decap.Windows() {
+		if window.Owner == owner(req) {
+			windows = append(windows, window)
+		}
+	}
+	writeJSON(w, windows)
+}
+
+func sessionHandler(w http.ResponseWriter, req *http.Request) {
+	id := req.PathValue("id")
+	window, ok := ownedWindow(req, id)
+	if !ok {
+		status := http.StatusNotFound
+		msg := fmt.Sprintf("%s: window session \"%s\" doesn't exist", http.StatusText(status), id)
+		http.Error(w, msg, status)
+		return
+	}
+	writeJSON(w, window)
+}
+
+func closeSessionHandler(w http.ResponseWriter, req *http.Request) {
+	id := req.PathValue("id")
+	if _, ok := ownedWindow(req, id); !ok || !decap.CloseWindow(id) {
+		status := http.StatusNotFound
+		msg := fmt.Sprintf("%s: window session \"%s\" doesn't exist", http.StatusText(status), id)
+		http.Error(w, msg, status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func closeTabHandler(w http.ResponseWriter, req *http.Request) {
+	id := req.PathValue("id")
+	if !ownsTab(req, id) || !decap.CloseTab(id) {
+		status := http.StatusNotFound
+		msg := fmt.Sprintf("%s: tab \"%s\" doesn't exist", http.StatusText(status), id)
+		http.Error(w, msg, status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ownsTab reports whether the client owns the window of the saved tab.
+func ownsTab(req *http.Request, id string) bool {
+	for _, window := range decap.Windows() {
+		if window.Owner != owner(req) {
+			continue
+		}
+		for _, tab := range window.Tabs {
+			if tab.ID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		status := http.StatusInternalServerError
+		msg := fmt.Sprintf("%s: %s", http.StatusText(status), "Couldn't encode response")
+		http.Error(w, msg, status)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	if _, err := setupTracing(""); err != nil {
+		t.Fatal(err)
+	}
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	return exporter
+}
+
+func TestTraceRequestContinuesTraceparent(t *testing.T) {
+	exporter := recordSpans(t)
+	req := httptest.NewRequest("POST", newBrowsePath, nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	ctx, span := traceRequest(req, "browse")
+	if got := trace.SpanContextFromContext(ctx); got.SpanID() != span.SpanContext().SpanID() {
+		t.Error("returned context doesn't carry the request span")
+	}
+	span.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	s := spans[0]
+	if got := s.SpanContext.TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace ID = %s, want the one of traceparent", got)
+	}
+	if got := s.Parent.SpanID().String(); got != "00f067aa0ba902b7" || !s.Parent.IsRemote() {
+		t.Errorf("parent = %s (remote %t), want remote span 00f067aa0ba902b7", got, s.Parent.IsRemote())
+	}
+	if s.SpanKind != trace.SpanKindServer {
+		t.Errorf("span kind = %v, want server", s.SpanKind)
+	}
+}
+
+func TestTraceRequestStartsNewTrace(t *testing.T) {
+	exporter := recordSpans(t)
+	req := httptest.NewRequest("POST", newBrowsePath, nil)
+	req.Header.Set("traceparent", "not a trace context")
+
+	_, span := traceRequest(req, "browse")
+	span.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	if spans[0].Parent.IsValid() {
+		t.Errorf("span has parent %s, want a new trace", spans[0].Parent.SpanID())
+	}
+}
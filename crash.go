@@ -0,0 +1,87 @@
+package decap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/chromedp/cdproto/inspector"
+	"github.com/chromedp/chromedp"
+)
+
+var (
+	ErrBrowserCrashed = errors.New("browser crashed")
+
+	windowCrash = make(chan session)
+	windowEvict = make(chan string)
+)
+
+// watchWindow reports the window to AllocateSessions if its browser exits or
+// its dummy tab crashes. Reports about windows that have already been closed
+// are ignored by the allocator.
+func (w session) watchWindow() {
+	chromedp.ListenTarget(w.ctx, func(ev interface{}) {
+		switch ev.(type) {
+		case *inspector.EventTargetCrashed, *inspector.EventDetached:
+			go func() { windowCrash <- w }()
+		}
+	})
+	go func() {
+		<-w.ctx.Done()
+		windowCrash <- w
+	}()
+}
+
+// watchTab marks the tab as crashed if its renderer crashes or is detached,
+// or if its browser exits. The tab's context is also canceled when its window
+// is closed, by DELETE /sessions/{id}, GC or Shutdown, which isn't a crash.
+// Chrome is only killed after that, whereas chromedp cancels the context of a
+// browser that has exited after losing the connection to it.
+func (ses *session) watchTab() {
+	ses.crashed = new(atomic.Bool)
+	crashed := ses.crashed
+	chromedp.ListenTarget(ses.ctx, func(ev interface{}) {
+		switch ev.(type) {
+		case *inspector.EventTargetCrashed, *inspector.EventDetached:
+			crashed.Store(true)
+		}
+	})
+	watched := make(chan struct{})
+	ses.watched = watched
+	ctx := ses.ctx
+	go func() {
+		defer close(watched)
+		<-ctx.Done()
+		if c := chromedp.FromContext(ctx); c != nil && c.Browser != nil {
+			select {
+			case <-c.Browser.LostConnection:
+				crashed.Store(true)
+			default:
+			}
+		}
+	}()
+}
+
+// crashError wraps err in ErrBrowserCrashed if the tab or the browser it
+// belongs to has crashed.
+func (ses session) crashError(err error) error {
+	if err == nil || ses.crashed == nil {
+		return err
+	}
+	if errors.Is(ses.ctx.Err(), context.Canceled) {
+		// wait for watchTab to tell an exited browser from a closed window
+		<-ses.watched
+	}
+	if ses.crashed.Load() {
+		return fmt.Errorf("%w: %s", ErrBrowserCrashed, err)
+	}
+	return err
+}
+
+// evictCrashedWindow makes AllocateSessions close and drop the window with the
+// given ID, even if only the renderer of one of its tabs crashed, so that a
+// retry doesn't land in the same window.
+func evictCrashedWindow(id string) {
+	windowEvict <- id
+}
@@ -0,0 +1,55 @@
+package decap
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/chromedp/chromedp"
+)
+
+// fakeTab returns a tab session on a fake browser, whose connection is lost
+// when lose is called, and a function canceling the tab like closing its
+// window does.
+func fakeTab() (tab session, lose, closeWindow func()) {
+	window, closeWindow := context.WithCancel(context.Background())
+	ctx, _ := chromedp.NewContext(window)
+	lost := make(chan struct{})
+	chromedp.FromContext(ctx).Browser = &chromedp.Browser{LostConnection: lost}
+	tab = session{id: "tab", ctx: ctx}
+	tab.watchTab()
+	return tab, func() { close(lost) }, closeWindow
+}
+
+func TestCrashErrorClosedWindow(t *testing.T) {
+	tab, lose, closeWindow := fakeTab()
+	closeWindow()
+	<-tab.watched // Chrome is killed after the window's context is canceled
+	lose()
+	err := tab.crashError(context.Canceled)
+	if errors.Is(err, ErrBrowserCrashed) {
+		t.Errorf("closing the window was reported as a crash: %s", err)
+	}
+}
+
+func TestCrashErrorBrowserExit(t *testing.T) {
+	tab, lose, closeWindow := fakeTab()
+	lose()
+	closeWindow()
+	if err := tab.crashError(context.Canceled); !errors.Is(err, ErrBrowserCrashed) {
+		t.Errorf("err = %v, want ErrBrowserCrashed", err)
+	}
+}
+
+func TestCrashErrorFlag(t *testing.T) {
+	tab, _, closeWindow := fakeTab()
+	defer closeWindow()
+	errEval := errors.New("eval failed")
+	if err := tab.crashError(errEval); err != errEval {
+		t.Errorf("err = %v, want it unchanged", err)
+	}
+	tab.crashed.Store(true)
+	if err := tab.crashError(errEval); !errors.Is(err, ErrBrowserCrashed) {
+		t.Errorf("err = %v, want ErrBrowserCrashed", err)
+	}
+}
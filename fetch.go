@@ -0,0 +1,356 @@
+package decap
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/fetch"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+)
+
+// A fetchHandler decides what happens to a request paused by the Fetch domain.
+// It returns nil when the request should be left to the next handler.
+type fetchHandler func(ev *fetch.EventRequestPaused) chromedp.Action
+
+type interceptor struct {
+	handlers  []fetchHandler
+	headers   map[string]string
+	origins   map[string]bool
+	listening bool
+	mainFrame cdp.FrameID
+	mu        sync.Mutex
+	blocked   map[string]int
+	pageHost  string
+	proxyAuth *fetch.AuthChallengeResponse
+	log       *slog.Logger
+	stop      context.CancelFunc
+	pending   sync.WaitGroup
+}
+
+func (ic *interceptor) enabled() bool {
+	return ic != nil && (len(ic.handlers) > 0 || len(ic.headers) > 0 || ic.proxyAuth != nil)
+}
+
+func (ic *interceptor) addHandler(h fetchHandler) {
+	ic.handlers = append(ic.handlers, h)
+}
+
+func (ic *interceptor) enable() chromedp.ActionFunc {
+	return func(ctx context.Context) error {
+		ic.mu.Lock()
+		if ic.listening {
+			ic.mu.Unlock()
+			return nil
+		}
+		ic.listening = true
+		ic.mainFrame = cdp.FrameID(chromedp.FromContext(ctx).Target.TargetID)
+		ic.mu.Unlock()
+		// the listener is removed by disable, so that it doesn't outlive the
+		// request when the tab is saved
+		var lctx context.Context
+		lctx, ic.stop = context.WithCancel(ctx)
+		chromedp.ListenTarget(lctx, func(ev interface{}) {
+			switch e := ev.(type) {
+			case *fetch.EventRequestPaused:
+				ic.spawn(func() { ic.resolve(lctx, e) })
+			case *fetch.EventAuthRequired:
+				ic.spawn(func() { ic.answerAuth(lctx, e) })
+			}
+		})
+		return fetch.Enable().WithHandleAuthRequests(ic.proxyAuth != nil).Do(ctx)
+	}
+}
+
+// disable stops the interception started by enable. It must be called before a
+// tab is handed to another request, or this request's rules and headers would
+// keep applying to it. It returns once the paused requests being resolved have
+// been given up, so the interceptor can be reused by a retry.
+func (ic *interceptor) disable(ctx context.Context) {
+	if ic == nil {
+		return
+	}
+	ic.mu.Lock()
+	listening := ic.listening
+	ic.listening = false
+	ic.mu.Unlock()
+	if !listening {
+		return
+	}
+	ic.stop()
+	ic.pending.Wait()
+	if err := chromedp.Run(ctx, fetch.Disable()); err != nil && ctx.Err() == nil {
+		ic.logger().Debug("Couldn't disable fetch interception", "err", err)
+	}
+}
+
+// spawn runs f in a goroutine that disable waits for, unless interception has
+// already been disabled.
+func (ic *interceptor) spawn(f func()) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if !ic.listening {
+		return
+	}
+	ic.pending.Add(1)
+	go func() {
+		defer ic.pending.Done()
+		f()
+	}()
+}
+
+func (ic *interceptor) resolve(ctx context.Context, ev *fetch.EventRequestPaused) {
+	if ev.ResourceType == network.ResourceTypeDocument && ev.FrameID == ic.mainFrame {
+		if u, err := url.Parse(ev.Request.URL); err == nil {
+			ic.mu.Lock()
+			ic.pageHost = strings.ToLower(u.Hostname())
+			ic.mu.Unlock()
+		}
+	}
+	var action chromedp.Action
+	for _, h := range ic.handlers {
+		if action = h(ev); action != nil {
+			break
+		}
+	}
+	if action == nil {
+		action = ic.continueRequest(ev, nil)
+	}
+	if err := action.Do(ctx); err != nil && ctx.Err() == nil {
+		ic.logger().Warn("Fetch interception failed", "url", ev.Request.URL, "err", err)
+	}
+}
+
+// continueRequest lets a paused request through with the interceptor's extra
+// headers and the given overrides applied. An empty override value removes the
+// header.
+func (ic *interceptor) continueRequest(ev *fetch.EventRequestPaused, overrides map[string]string) chromedp.Action {
+	extra := ic.extraHeaders(ev.Request.URL)
+	if len(extra) == 0 && len(overrides) == 0 {
+		return fetch.ContinueRequest(ev.RequestID)
+	}
+	headers := make(map[string]string)
+	for k, v := range ev.Request.Headers {
+		headers[http.CanonicalHeaderKey(k)] = fmt.Sprint(v)
+	}
+	for _, m := range []map[string]string{extra, overrides} {
+		for k, v := range m {
+			if v == "" {
+				delete(headers, http.CanonicalHeaderKey(k))
+			} else {
+				headers[http.CanonicalHeaderKey(k)] = v
+			}
+		}
+	}
+	return fetch.ContinueRequest(ev.RequestID).WithHeaders(headerEntries(headers))
+}
+
+// allowHeaders lets the extra headers be sent to the origin of rawURL. It is
+// called with the URLs the request navigates to.
+func (ic *interceptor) allowHeaders(rawURL string) {
+	origin := urlOrigin(rawURL)
+	if origin == "" {
+		return
+	}
+	if ic.origins == nil {
+		ic.origins = make(map[string]bool)
+	}
+	ic.origins[origin] = true
+}
+
+// extraHeaders returns the extra headers for a request to rawURL. They often
+// carry credentials, so third-party requests don't get them.
+func (ic *interceptor) extraHeaders(rawURL string) map[string]string {
+	if len(ic.headers) == 0 || !ic.origins[urlOrigin(rawURL)] {
+		return nil
+	}
+	return ic.headers
+}
+
+// urlOrigin returns the scheme, host and port of rawURL, leaving out default
+// ports, or "" if it has no host.
+func urlOrigin(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	scheme := strings.ToLower(u.Scheme)
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if scheme == "http" && port == "80" || scheme == "https" && port == "443" {
+		port = ""
+	}
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return scheme + "://" + host
+}
+
+func (ic *interceptor) logger() *slog.Logger {
+	if ic.log == nil {
+		return Logger
+	}
+	return ic.log
+}
+
+// reset prepares the interceptor for use in a new tab.
+func (ic *interceptor) reset() {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	ic.listening = false
+	ic.blocked = nil
+	ic.pageHost = ""
+}
+
+// documentHost returns the host of the page currently loaded in the tab's main
+// frame, as seen by the interceptor.
+func (ic *interceptor) documentHost() string {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	return ic.pageHost
+}
+
+func (ic *interceptor) countBlocked(resourceType network.ResourceType) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if ic.blocked == nil {
+		ic.blocked = make(map[string]int)
+	}
+	ic.blocked[strings.ToLower(string(resourceType))]++
+}
+
+func (ic *interceptor) blockedCounts() map[string]int {
+	if ic == nil {
+		return nil
+	}
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	counts := make(map[string]int, len(ic.blocked))
+	for k, v := range ic.blocked {
+		counts[k] = v
+	}
+	return counts
+}
+
+func (ic *interceptor) blockRequest(ev *fetch.EventRequestPaused) chromedp.Action {
+	ic.countBlocked(ev.ResourceType)
+	return fetch.FailRequest(ev.RequestID, network.ErrorReasonBlockedByClient)
+}
+
+type blockRules struct {
+	patterns      []*regexp.Regexp
+	resourceTypes map[network.ResourceType]bool
+	thirdParty    bool
+}
+
+func (b *blockRules) match(ev *fetch.EventRequestPaused) bool {
+	for _, re := range b.patterns {
+		if re.MatchString(ev.Request.URL) {
+			return true
+		}
+	}
+	if !b.resourceTypes[ev.ResourceType] {
+		return false
+	}
+	return !b.thirdParty || !ev.Request.IsSameSite
+}
+
+type interceptRule struct {
+	pattern  *regexp.Regexp
+	action   string
+	status   int64
+	body     string
+	headers  map[string]string
+	location string
+}
+
+func (rule *interceptRule) apply(ic *interceptor, ev *fetch.EventRequestPaused) chromedp.Action {
+	if !rule.pattern.MatchString(ev.Request.URL) {
+		return nil
+	}
+	switch rule.action {
+	case "fulfil":
+		return fetch.FulfillRequest(ev.RequestID, rule.status).
+			WithResponseHeaders(headerEntries(rule.headers)).
+			WithBody(base64.StdEncoding.EncodeToString([]byte(rule.body)))
+	case "headers":
+		return ic.continueRequest(ev, rule.headers)
+	case "redirect":
+		headers := map[string]string{"Location": rule.location}
+		for k, v := range rule.headers {
+			headers[k] = v
+		}
+		return fetch.FulfillRequest(ev.RequestID, rule.status).
+			WithResponseHeaders(headerEntries(headers))
+	}
+	return nil
+}
+
+func headerEntries(headers map[string]string) []*fetch.HeaderEntry {
+	entries := make([]*fetch.HeaderEntry, 0, len(headers))
+	for k, v := range headers {
+		entries = append(entries, &fetch.HeaderEntry{Name: k, Value: v})
+	}
+	return entries
+}
+
+// compileURLPattern accepts either a glob, where "*" matches any sequence of
+// characters and "?" matches a single one, or a regular expression enclosed in
+// slashes (e.g. "/\.mp4$/").
+func compileURLPattern(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		return regexp.Compile(pattern[1 : len(pattern)-1])
+	}
+	var expr strings.Builder
+	expr.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+func parseResourceType(name string) (network.ResourceType, error) {
+	for _, t := range []network.ResourceType{
+		network.ResourceTypeDocument,
+		network.ResourceTypeStylesheet,
+		network.ResourceTypeImage,
+		network.ResourceTypeMedia,
+		network.ResourceTypeFont,
+		network.ResourceTypeScript,
+		network.ResourceTypeTextTrack,
+		network.ResourceTypeXHR,
+		network.ResourceTypeFetch,
+		network.ResourceTypePrefetch,
+		network.ResourceTypeEventSource,
+		network.ResourceTypeWebSocket,
+		network.ResourceTypeManifest,
+		network.ResourceTypeSignedExchange,
+		network.ResourceTypePing,
+		network.ResourceTypeCSPViolationReport,
+		network.ResourceTypePreflight,
+		network.ResourceTypeOther,
+	} {
+		if strings.EqualFold(name, string(t)) {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf(`unknown resource type "%s"`, name)
+}
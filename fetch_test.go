@@ -0,0 +1,223 @@
+package decap
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chromedp/cdproto/fetch"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+)
+
+func pausedRequest(rawURL string, headers network.Headers) *fetch.EventRequestPaused {
+	return &fetch.EventRequestPaused{
+		RequestID:    "interception-1",
+		Request:      &network.Request{URL: rawURL, Headers: headers},
+		ResourceType: network.ResourceTypeDocument,
+	}
+}
+
+// handle runs the request's fetch handlers the way interceptor.resolve does,
+// and returns the action decided for ev.
+func handle(r *Request, ev *fetch.EventRequestPaused) chromedp.Action {
+	for _, h := range r.interceptor.handlers {
+		if action := h(ev); action != nil {
+			return action
+		}
+	}
+	return r.interceptor.continueRequest(ev, nil)
+}
+
+func headerMap(entries []*fetch.HeaderEntry) map[string]string {
+	m := make(map[string]string)
+	for _, e := range entries {
+		m[e.Name] = e.Value
+	}
+	return m
+}
+
+func TestCompileURLPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		url     string
+		match   bool
+	}{
+		{"https://example.com/*", "https://example.com/a/b?c", true},
+		{"https://example.com/*", "https://example.com.evil.test/", false},
+		{"*.png", "https://cdn.test/logo.png", true},
+		{"*.png", "https://cdn.test/logo.png?v=2", false},
+		{"https://example.com/?", "https://example.com/a", true},
+		{"https://example.com/?", "https://example.com/ab", false},
+		{"https://example.com/a+b", "https://example.com/a+b", true},
+		{`/\.mp4$/`, "https://video.test/clip.mp4", true},
+		{`/\.mp4$/`, "https://video.test/clip.mp4.html", false},
+	}
+	for _, tt := range tests {
+		re, err := compileURLPattern(tt.pattern)
+		if err != nil {
+			t.Errorf("compileURLPattern(%q): %s", tt.pattern, err)
+			continue
+		}
+		if got := re.MatchString(tt.url); got != tt.match {
+			t.Errorf("pattern %q matching %q = %t, want %t", tt.pattern, tt.url, got, tt.match)
+		}
+	}
+	if _, err := compileURLPattern("/(/"); err == nil {
+		t.Error("compileURLPattern accepted an invalid regular expression")
+	}
+}
+
+func TestInterceptFulfil(t *testing.T) {
+	r := mustParse(t, `{
+		"global_render_delay": "0s",
+		"intercept": [{
+			"url": "https://decap.test/api/*",
+			"action": "fulfil",
+			"status": 404,
+			"body": "{\"error\": \"gone\"}",
+			"headers": {"Content-Type": "application/json"}
+		}],
+		"query": [{"actions": [["navigate", "https://decap.test/"], ["eval", "1"]]}]
+	}`)
+
+	action, ok := handle(r, pausedRequest("https://decap.test/api/jobs", nil)).(*fetch.FulfillRequestParams)
+	if !ok {
+		t.Fatalf("matching request wasn't fulfilled")
+	}
+	body, _ := base64.StdEncoding.DecodeString(action.Body)
+	if action.ResponseCode != 404 || string(body) != `{"error": "gone"}` {
+		t.Errorf("fulfilled with %d %q", action.ResponseCode, body)
+	}
+	if got := headerMap(action.ResponseHeaders)["Content-Type"]; got != "application/json" {
+		t.Errorf("Content-Type = %q", got)
+	}
+
+	if _, ok := handle(r, pausedRequest("https://decap.test/", nil)).(*fetch.ContinueRequestParams); !ok {
+		t.Errorf("request not matching the rule wasn't continued")
+	}
+}
+
+func TestInterceptRedirectAndHeaders(t *testing.T) {
+	r := mustParse(t, `{
+		"global_render_delay": "0s",
+		"intercept": [
+			{"url": "https://old.test/*", "action": "redirect", "location": "https://new.test/"},
+			{"url": "https://api.test/*", "action": "headers", "headers": {"X-Mock": "1", "Cookie": ""}}
+		],
+		"query": [{"actions": [["navigate", "https://old.test/"], ["eval", "1"]]}]
+	}`)
+
+	redirect, ok := handle(r, pausedRequest("https://old.test/page", nil)).(*fetch.FulfillRequestParams)
+	if !ok {
+		t.Fatalf("redirect rule didn't fulfil the request")
+	}
+	if redirect.ResponseCode != 302 || headerMap(redirect.ResponseHeaders)["Location"] != "https://new.test/" {
+		t.Errorf("redirected with %d %v", redirect.ResponseCode, headerMap(redirect.ResponseHeaders))
+	}
+
+	ev := pausedRequest("https://api.test/v1", network.Headers{"accept": "*/*", "cookie": "a=b"})
+	cont, ok := handle(r, ev).(*fetch.ContinueRequestParams)
+	if !ok {
+		t.Fatalf("headers rule didn't continue the request")
+	}
+	want := map[string]string{"Accept": "*/*", "X-Mock": "1"}
+	if got := headerMap(cont.Headers); !equalHeaders(got, want) {
+		t.Errorf("headers = %v, want %v", got, want)
+	}
+}
+
+func TestExtraHeadersOnlyForNavigatedOrigins(t *testing.T) {
+	r := mustParse(t, `{
+		"global_render_delay": "0s",
+		"extra_headers": {"Authorization": "Bearer secret"},
+		"query": [{"actions": [["navigate", "https://app.test:443/login"], ["eval", "1"]]}]
+	}`)
+
+	tests := []struct {
+		url  string
+		sent bool
+	}{
+		{"https://app.test/login", true},
+		{"https://APP.test/static/app.js", true},
+		{"http://app.test/", false},
+		{"https://app.test:8443/", false},
+		{"https://tracker.test/pixel.gif", false},
+		{"https://app.test.evil.test/", false},
+	}
+	for _, tt := range tests {
+		cont, ok := handle(r, pausedRequest(tt.url, network.Headers{"accept": "*/*"})).(*fetch.ContinueRequestParams)
+		if !ok {
+			t.Fatalf("%s: request wasn't continued", tt.url)
+		}
+		sent := headerMap(cont.Headers)["Authorization"] == "Bearer secret"
+		if sent != tt.sent {
+			t.Errorf("%s: Authorization sent = %t, want %t", tt.url, sent, tt.sent)
+		}
+	}
+}
+
+func TestParseInterceptErrors(t *testing.T) {
+	tests := []struct {
+		rule string
+		err  string
+	}{
+		{`null`, "rule can't be null"},
+		{`{"action": "fulfil"}`, "url is empty"},
+		{`{"url": "/(/", "action": "fulfil"}`, "intercept[0].url"},
+		{`{"url": "*", "action": "block"}`, `unknown action "block"`},
+		{`{"url": "*", "action": "headers"}`, "at least one header"},
+		{`{"url": "*", "action": "redirect"}`, "location is empty"},
+		{`{"url": "*", "action": "fulfil", "status": 99}`, "invalid HTTP status 99"},
+	}
+	for _, tt := range tests {
+		body := `{
+			"global_render_delay": "0s",
+			"intercept": [` + tt.rule + `],
+			"query": [{"actions": [["navigate", "https://decap.test/"], ["eval", "1"]]}]
+		}`
+		var r Request
+		err := r.ParseRequest(strings.NewReader(body))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("rule %s: err = %v, want it to mention %q", tt.rule, err, tt.err)
+		}
+	}
+}
+
+func TestDisableWaitsForResolvers(t *testing.T) {
+	ctx, stop := context.WithCancel(context.Background())
+	ic := &interceptor{listening: true, stop: stop}
+	var running atomic.Int32
+	started := make(chan struct{})
+	ic.spawn(func() {
+		running.Add(1)
+		close(started)
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		running.Add(-1)
+	})
+	<-started
+
+	ic.disable(context.Background())
+	if n := running.Load(); n != 0 {
+		t.Fatalf("%d resolvers still running after disable", n)
+	}
+	ic.spawn(func() { t.Error("resolver spawned after disable") })
+	// a retry may now replace the logger without racing the old resolvers
+	ic.log = Logger
+}
+
+func equalHeaders(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
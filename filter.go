@@ -0,0 +1,468 @@
+package decap
+
+import (
+	"bufio"
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/chromedp/cdproto/fetch"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/chromedp"
+)
+
+//go:embed filters/*.txt
+var bundledFilters embed.FS
+
+var (
+	filterListsMu sync.RWMutex
+	filterLists   = make(map[string]*filterList)
+
+	filterOptionsRegexp = regexp.MustCompile(`^[\w~,=|.*-]+$`)
+)
+
+func init() {
+	err := loadFilterFS(bundledFilters, "filters")
+	if err != nil {
+		panic(fmt.Sprintf("bundled filter lists: %s", err))
+	}
+}
+
+// LoadFilterLists reads every *.txt file in dir as an Adblock Plus/EasyList
+// filter list, making it available to requests under its base name (e.g.
+// "easylist" for easylist.txt). Lists in dir replace bundled lists of the same
+// name.
+func LoadFilterLists(dir string) error {
+	return loadFilterFS(os.DirFS(dir), ".")
+}
+
+func loadFilterFS(fsys fs.FS, dir string) error {
+	paths, err := fs.Glob(fsys, path.Join(dir, "*.txt"))
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		f, err := fsys.Open(p)
+		if err != nil {
+			return err
+		}
+		list, err := parseFilterList(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", p, err)
+		}
+		name := strings.TrimSuffix(path.Base(p), ".txt")
+		filterListsMu.Lock()
+		filterLists[name] = list
+		filterListsMu.Unlock()
+	}
+	return nil
+}
+
+func lookupFilterList(name string) (*filterList, bool) {
+	filterListsMu.RLock()
+	defer filterListsMu.RUnlock()
+	list, ok := filterLists[name]
+	return list, ok
+}
+
+type filterList struct {
+	// network rules anchored with "||host^" are indexed by host, all other
+	// network rules are matched one by one
+	hostRules map[string][]*networkFilter
+	rules     []*networkFilter
+	cosmetic  []*cosmeticFilter
+}
+
+type networkFilter struct {
+	pattern    *regexp.Regexp
+	exception  bool
+	types      map[string]bool
+	notTypes   map[string]bool
+	thirdParty *bool
+	domains    []string
+	notDomains []string
+	matchCase  bool
+}
+
+type cosmeticFilter struct {
+	selector   string
+	exception  bool
+	domains    []string
+	notDomains []string
+}
+
+func parseFilterList(r io.Reader) (*filterList, error) {
+	list := &filterList{hostRules: make(map[string][]*networkFilter)}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+			continue
+		}
+		if cf, ok := parseCosmeticFilter(line); ok {
+			if cf != nil {
+				list.cosmetic = append(list.cosmetic, cf)
+			}
+			continue
+		}
+		nf, host := parseNetworkFilter(line)
+		switch {
+		case nf == nil:
+		case host != "":
+			list.hostRules[host] = append(list.hostRules[host], nf)
+		default:
+			list.rules = append(list.rules, nf)
+		}
+	}
+	return list, scanner.Err()
+}
+
+// parseCosmeticFilter reports whether line is an element hiding rule. The
+// returned filter is nil for cosmetic rule types that aren't supported (e.g.
+// extended CSS and scriptlets).
+func parseCosmeticFilter(line string) (*cosmeticFilter, bool) {
+	for _, sep := range []string{"#?#", "#@?#", "#$#", "#@$#", "#%#", "#@%#", "$$", "$@$"} {
+		if strings.Contains(line, sep) {
+			return nil, true
+		}
+	}
+	cf := &cosmeticFilter{}
+	var domains string
+	if i := strings.Index(line, "#@#"); i >= 0 {
+		cf.exception = true
+		domains, cf.selector = line[:i], line[i+3:]
+	} else if i = strings.Index(line, "##"); i >= 0 {
+		domains, cf.selector = line[:i], line[i+2:]
+	} else {
+		return nil, false
+	}
+	if cf.selector == "" || strings.ContainsAny(cf.selector, "{}") {
+		return nil, true
+	}
+	cf.domains, cf.notDomains = splitDomains(domains, ",")
+	return cf, true
+}
+
+// parseNetworkFilter turns a blocking or exception rule into a filter. It
+// returns nil for rules with options that decap can't honour. If the rule is
+// of the form "||host^", host is returned for indexing.
+func parseNetworkFilter(line string) (nf *networkFilter, host string) {
+	nf = &networkFilter{}
+	if strings.HasPrefix(line, "@@") {
+		nf.exception = true
+		line = line[2:]
+	}
+	if i := strings.LastIndex(line, "$"); i >= 0 && filterOptionsRegexp.MatchString(line[i+1:]) {
+		if !nf.parseOptions(line[i+1:]) {
+			return nil, ""
+		}
+		line = line[:i]
+	}
+	if line == "" {
+		line = "*"
+	}
+
+	var expr string
+	if len(line) > 2 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") {
+		expr = line[1 : len(line)-1]
+	} else {
+		if m := hostFilterRegexp.FindStringSubmatch(line); m != nil {
+			host = strings.ToLower(m[1])
+		}
+		expr = filterPatternToRegexp(line)
+	}
+	if !nf.matchCase {
+		expr = "(?i)" + expr
+	}
+	var err error
+	if nf.pattern, err = regexp.Compile(expr); err != nil {
+		return nil, ""
+	}
+	return nf, host
+}
+
+var hostFilterRegexp = regexp.MustCompile(`^\|\|([a-zA-Z0-9.-]+)\^`)
+
+func filterPatternToRegexp(pattern string) string {
+	var expr strings.Builder
+	switch {
+	case strings.HasPrefix(pattern, "||"):
+		expr.WriteString(`^[a-z][a-z0-9+.-]*://([^/?#]*\.)?`)
+		pattern = pattern[2:]
+	case strings.HasPrefix(pattern, "|"):
+		expr.WriteString("^")
+		pattern = pattern[1:]
+	}
+	anchorEnd := strings.HasSuffix(pattern, "|")
+	pattern = strings.TrimSuffix(pattern, "|")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			expr.WriteString(".*")
+		case '^':
+			expr.WriteString(`(?:[^\w.%-]|$)`)
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	if anchorEnd {
+		expr.WriteString("$")
+	}
+	return expr.String()
+}
+
+func (nf *networkFilter) parseOptions(options string) bool {
+	for _, opt := range strings.Split(options, ",") {
+		negated := strings.HasPrefix(opt, "~")
+		name := strings.TrimPrefix(opt, "~")
+		switch name {
+		case "script", "image", "stylesheet", "object", "xmlhttprequest",
+			"subdocument", "ping", "websocket", "font", "media", "other":
+			if negated {
+				nf.notTypes = addToSet(nf.notTypes, name)
+			} else {
+				nf.types = addToSet(nf.types, name)
+			}
+		case "third-party", "3p", "first-party", "1p":
+			thirdParty := (name == "third-party" || name == "3p") != negated
+			nf.thirdParty = &thirdParty
+		case "match-case":
+			nf.matchCase = true
+		case "important":
+		default:
+			if strings.HasPrefix(opt, "domain=") {
+				nf.domains, nf.notDomains = splitDomains(strings.TrimPrefix(opt, "domain="), "|")
+				continue
+			}
+			return false
+		}
+	}
+	return true
+}
+
+func (nf *networkFilter) match(req *filterRequest) bool {
+	if len(nf.types) > 0 && !nf.types[req.resourceType] {
+		return false
+	}
+	if nf.notTypes[req.resourceType] {
+		return false
+	}
+	if nf.thirdParty != nil && *nf.thirdParty != req.thirdParty {
+		return false
+	}
+	if !matchDomains(req.pageHost, nf.domains, nf.notDomains) {
+		return false
+	}
+	return nf.pattern.MatchString(req.url)
+}
+
+type filterRequest struct {
+	url          string
+	host         string
+	pageHost     string
+	resourceType string
+	thirdParty   bool
+}
+
+func newFilterRequest(ev *fetch.EventRequestPaused, pageHost string) *filterRequest {
+	req := &filterRequest{
+		url:          ev.Request.URL,
+		pageHost:     pageHost,
+		resourceType: filterResourceType(ev.ResourceType),
+		thirdParty:   !ev.Request.IsSameSite,
+	}
+	if u, err := url.Parse(ev.Request.URL); err == nil {
+		req.host = strings.ToLower(u.Hostname())
+	}
+	return req
+}
+
+func filterResourceType(t network.ResourceType) string {
+	switch t {
+	case network.ResourceTypeScript:
+		return "script"
+	case network.ResourceTypeImage:
+		return "image"
+	case network.ResourceTypeStylesheet:
+		return "stylesheet"
+	case network.ResourceTypeXHR, network.ResourceTypeFetch, network.ResourceTypeEventSource:
+		return "xmlhttprequest"
+	case network.ResourceTypeDocument:
+		return "subdocument"
+	case network.ResourceTypePing, network.ResourceTypeCSPViolationReport:
+		return "ping"
+	case network.ResourceTypeWebSocket:
+		return "websocket"
+	case network.ResourceTypeFont:
+		return "font"
+	case network.ResourceTypeMedia:
+		return "media"
+	default:
+		return "other"
+	}
+}
+
+// filterSet combines the filter lists selected by a request.
+type filterSet []*filterList
+
+func (fs filterSet) blocks(req *filterRequest) bool {
+	blocked := false
+	for _, list := range fs {
+		for _, nf := range list.candidates(req.host) {
+			if !nf.match(req) {
+				continue
+			}
+			if nf.exception {
+				return false
+			}
+			blocked = true
+		}
+	}
+	return blocked
+}
+
+func (list *filterList) candidates(host string) []*networkFilter {
+	candidates := list.rules
+	for h := host; h != ""; {
+		if rules, ok := list.hostRules[h]; ok {
+			candidates = append(candidates[:len(candidates):len(candidates)], rules...)
+		}
+		i := strings.IndexByte(h, '.')
+		if i < 0 {
+			break
+		}
+		h = h[i+1:]
+	}
+	return candidates
+}
+
+// hidingScript returns JavaScript that injects the element hiding rules of
+// the filter set as a style sheet into every document.
+func (fs filterSet) hidingScript() string {
+	type rule struct {
+		Selector   string   `json:"s"`
+		Domains    []string `json:"d,omitempty"`
+		NotDomains []string `json:"n,omitempty"`
+	}
+	generic := make([]string, 0)
+	specific := make([]rule, 0)
+	exceptions := make([]rule, 0)
+	for _, list := range fs {
+		for _, cf := range list.cosmetic {
+			r := rule{cf.selector, cf.domains, cf.notDomains}
+			switch {
+			case cf.exception:
+				exceptions = append(exceptions, r)
+			case len(cf.domains) == 0 && len(cf.notDomains) == 0:
+				generic = append(generic, cf.selector)
+			default:
+				specific = append(specific, r)
+			}
+		}
+	}
+	data, _ := json.Marshal([]interface{}{generic, specific, exceptions})
+	return fmt.Sprintf(hidingScriptFmt, data)
+}
+
+// addHidingScript injects the element hiding script of the request into
+// every document the tab loads.
+func (r *Request) addHidingScript() chromedp.ActionFunc {
+	return func(ctx context.Context) (err error) {
+		r.hidingScriptID, err = page.AddScriptToEvaluateOnNewDocument(r.hidingScript).Do(ctx)
+		return err
+	}
+}
+
+// removeHidingScript stops injecting the element hiding script. It must be
+// called before a tab is handed to another request, which may use other
+// filter lists or none.
+func (r *Request) removeHidingScript(ctx context.Context) {
+	if r.hidingScriptID == "" {
+		return
+	}
+	id := r.hidingScriptID
+	r.hidingScriptID = ""
+	if err := chromedp.Run(ctx, page.RemoveScriptToEvaluateOnNewDocument(id)); err != nil && ctx.Err() == nil {
+		r.log().Debug("Couldn't remove element hiding script", "err", err)
+	}
+}
+
+const hidingScriptFmt = `(() => {
+	const [generic, specific, exceptions] = %s;
+	const host = location.hostname;
+	const onDomain = d => host === d || host.endsWith("." + d);
+	const applies = r => (!r.d || r.d.some(onDomain)) && !(r.n || []).some(onDomain);
+	const excepted = new Set(exceptions.filter(applies).map(r => r.s));
+	const selectors = generic.concat(specific.filter(applies).map(r => r.s))
+		.filter(s => !excepted.has(s));
+	if (selectors.length === 0) {
+		return;
+	}
+	const inject = () => {
+		const style = document.createElement("style");
+		style.textContent = selectors.map(s => s + " { display: none !important; }").join("\n");
+		(document.head || document.documentElement).appendChild(style);
+	};
+	if (document.documentElement) {
+		inject();
+	} else {
+		document.addEventListener("DOMContentLoaded", inject);
+	}
+})();`
+
+func splitDomains(list, sep string) (domains, notDomains []string) {
+	if list == "" {
+		return
+	}
+	for _, d := range strings.Split(list, sep) {
+		d = strings.ToLower(strings.TrimSpace(d))
+		switch {
+		case d == "" || d == "~":
+		case strings.HasPrefix(d, "~"):
+			notDomains = append(notDomains, d[1:])
+		default:
+			domains = append(domains, d)
+		}
+	}
+	return
+}
+
+func matchDomains(host string, domains, notDomains []string) bool {
+	onDomain := func(d string) bool {
+		return host == d || strings.HasSuffix(host, "."+d)
+	}
+	for _, d := range notDomains {
+		if onDomain(d) {
+			return false
+		}
+	}
+	if len(domains) == 0 {
+		return true
+	}
+	for _, d := range domains {
+		if onDomain(d) {
+			return true
+		}
+	}
+	return false
+}
+
+func addToSet(set map[string]bool, key string) map[string]bool {
+	if set == nil {
+		set = make(map[string]bool)
+	}
+	set[key] = true
+	return set
+}
@@ -0,0 +1,58 @@
+package decap
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestHidingScriptIsRemovedFromSavedTab checks that the element hiding rules
+// of a request don't apply to the next request loading its saved tab.
+func TestHidingScriptIsRemovedFromSavedTab(t *testing.T) {
+	startBrowser(t)
+	const intercept = `"intercept": [{
+		"url": "https://decap.test/*",
+		"action": "fulfil",
+		"body": "<ins class=\"adsbygoogle\">ad</ins>",
+		"headers": {"Content-Type": "text/html"}
+	}]`
+	const display = `["eval", "getComputedStyle(document.querySelector('ins')).display"]`
+
+	r := mustParse(t, `{
+		"global_render_delay": "0s",
+		"timeout": "20s",
+		"reuse_tab": true,
+		"filter_lists": ["decap"],
+		`+intercept+`,
+		"query": [{"actions": [
+			["navigate", "https://decap.test/"],
+			["listen", "load"],
+			`+display+`
+		]}]
+	}`)
+	res, err := r.Execute()
+	if err != nil {
+		t.Fatalf("Execute: %s", err)
+	}
+	if got := res.Out[0][0]; got != `"none"` {
+		t.Fatalf("display with filter list = %s, want \"none\"", got)
+	}
+
+	r = mustParse(t, fmt.Sprintf(`{
+		"global_render_delay": "0s",
+		"timeout": "20s",
+		%s,
+		"query": [{"actions": [
+			["load_tab", "%s"],
+			["navigate", "https://decap.test/"],
+			["listen", "load"],
+			%s
+		]}]
+	}`, intercept, res.TabID, display))
+	res, err = r.Execute()
+	if err != nil {
+		t.Fatalf("Execute: %s", err)
+	}
+	if got := res.Out[0][0]; got != `"inline"` {
+		t.Errorf("display in saved tab without filter list = %s, want \"inline\"", got)
+	}
+}
@@ -0,0 +1,167 @@
+package decap
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/chromedp/chromedp"
+)
+
+// A LaunchProfile holds the command-line options Chrome is launched with.
+// Unset fields fall back to chromedp's defaults.
+type LaunchProfile struct {
+	ExecPath    string                 `json:"exec_path"`
+	Headless    *bool                  `json:"headless"`
+	DisableGPU  bool                   `json:"disable_gpu"`
+	NoSandbox   bool                   `json:"no_sandbox"`
+	ProxyServer string                 `json:"proxy_server"`
+	Lang        string                 `json:"lang"`
+	WindowSize  []int                  `json:"window_size"`
+	UserDataDir string                 `json:"user_data_dir"`
+	Flags       map[string]interface{} `json:"flags"`
+}
+
+// A LaunchConfig holds the default launch profile and a set of named
+// profiles, which requests can select with browser_profile. Named profiles
+// inherit the fields they leave unset from the default profile.
+type LaunchConfig struct {
+	Default  LaunchProfile            `json:"default"`
+	Profiles map[string]LaunchProfile `json:"profiles"`
+}
+
+// Launch configures the browsers started by AllocateSessions. It should not
+// be changed after AllocateSessions has been started.
+var Launch LaunchConfig
+
+// LoadLaunchConfig reads a JSON launch configuration from path into Launch.
+func LoadLaunchConfig(path string) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var conf LaunchConfig
+	if err = json.Unmarshal(buf, &conf); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	if err = conf.validate(); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	Launch = conf
+	return nil
+}
+
+func (conf LaunchConfig) validate() error {
+	if err := conf.Default.validate(); err != nil {
+		return fmt.Errorf("default: %s", err)
+	}
+	for name, p := range conf.Profiles {
+		if name == "" {
+			return fmt.Errorf("profiles: profile name can't be empty")
+		}
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("profiles.%s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func (p LaunchProfile) validate() error {
+	if p.WindowSize != nil && (len(p.WindowSize) != 2 || p.WindowSize[0] <= 0 || p.WindowSize[1] <= 0) {
+		return fmt.Errorf("window_size: expected [width, height]")
+	}
+	for name, v := range p.Flags {
+		switch v.(type) {
+		case bool, string, float64:
+		default:
+			return fmt.Errorf("flags.%s: expected boolean, string or number", name)
+		}
+	}
+	return nil
+}
+
+func validLaunchProfile(name string) bool {
+	if name == "" {
+		return true
+	}
+	_, ok := Launch.Profiles[name]
+	return ok
+}
+
+// launchProfile returns the named profile merged with the default profile.
+func launchProfile(name string) LaunchProfile {
+	p := Launch.Default
+	named, ok := Launch.Profiles[name]
+	if !ok {
+		return p
+	}
+	flags := make(map[string]interface{})
+	for k, v := range p.Flags {
+		flags[k] = v
+	}
+	for k, v := range named.Flags {
+		flags[k] = v
+	}
+	p.Flags = flags
+	if named.ExecPath != "" {
+		p.ExecPath = named.ExecPath
+	}
+	if named.Headless != nil {
+		p.Headless = named.Headless
+	}
+	p.DisableGPU = p.DisableGPU || named.DisableGPU
+	p.NoSandbox = p.NoSandbox || named.NoSandbox
+	if named.ProxyServer != "" {
+		p.ProxyServer = named.ProxyServer
+	}
+	if named.Lang != "" {
+		p.Lang = named.Lang
+	}
+	if named.WindowSize != nil {
+		p.WindowSize = named.WindowSize
+	}
+	if named.UserDataDir != "" {
+		p.UserDataDir = named.UserDataDir
+	}
+	return p
+}
+
+func (p LaunchProfile) allocatorOptions() []chromedp.ExecAllocatorOption {
+	var opts []chromedp.ExecAllocatorOption
+	if !debugMode {
+		// debug mode launches a visible browser without chromedp's defaults
+		opts = append(opts, chromedp.DefaultExecAllocatorOptions[:]...)
+	}
+	if p.ExecPath != "" {
+		opts = append(opts, chromedp.ExecPath(p.ExecPath))
+	}
+	if p.Headless != nil {
+		opts = append(opts, chromedp.Flag("headless", *p.Headless))
+	}
+	if p.DisableGPU {
+		opts = append(opts, chromedp.DisableGPU)
+	}
+	if p.NoSandbox {
+		opts = append(opts, chromedp.NoSandbox)
+	}
+	if p.ProxyServer != "" {
+		opts = append(opts, chromedp.ProxyServer(p.ProxyServer))
+	}
+	if p.Lang != "" {
+		opts = append(opts, chromedp.Flag("lang", p.Lang))
+	}
+	if len(p.WindowSize) == 2 {
+		opts = append(opts, chromedp.WindowSize(p.WindowSize[0], p.WindowSize[1]))
+	}
+	if p.UserDataDir != "" {
+		opts = append(opts, chromedp.UserDataDir(p.UserDataDir))
+	}
+	for name, v := range p.Flags {
+		if f, ok := v.(float64); ok {
+			v = strconv.FormatFloat(f, 'f', -1, 64)
+		}
+		opts = append(opts, chromedp.Flag(name, v))
+	}
+	return opts
+}
@@ -0,0 +1,36 @@
+package decap
+
+import (
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+)
+
+// Logger receives all log output of the package. Request-scoped lines carry
+// a request_id attribute, and lines about windows and tabs carry session and
+// tab attributes.
+var Logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// NewRequestID returns a random ID for requests that don't come with one.
+func NewRequestID() string {
+	return fmt.Sprintf("%016x", rand.Uint64())
+}
+
+// SetID sets the ID attached to the request's log lines, e.g. from an
+// X-Request-ID header.
+func (r *Request) SetID(id string) {
+	r.id = id
+}
+
+// ID returns the request's ID, generating one if none was set.
+func (r *Request) ID() string {
+	if r.id == "" {
+		r.id = NewRequestID()
+	}
+	return r.id
+}
+
+func (r *Request) log() *slog.Logger {
+	return Logger.With("request_id", r.ID(), "session", r.SessionID)
+}
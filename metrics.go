@@ -0,0 +1,179 @@
+package decap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/chromedp/chromedp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The metrics are registered with prometheus.DefaultRegisterer, so that they
+// are served by promhttp.Handler. StateCollector must be registered by the
+// program.
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "decap_requests_total",
+		Help: "Executed requests by outcome.",
+	}, []string{"outcome"})
+
+	actionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "decap_action_duration_seconds",
+		Help:    "Time spent executing query actions.",
+		Buckets: []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"action"})
+
+	listenWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "decap_listen_wait_seconds",
+		Help:    "Time spent waiting for the page lifecycle events of listen actions.",
+		Buckets: []float64{.1, .25, .5, 1, 2.5, 5, 10, 20, 60},
+	})
+
+	windowEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "decap_window_evictions_total",
+		Help: "Windows closed by decap, by reason (timeout or crash).",
+	}, []string{"reason"})
+
+	artifactBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "decap_artifact_bytes",
+		Help:    "Size of the screenshots and PDFs returned by requests.",
+		Buckets: prometheus.ExponentialBuckets(16<<10, 4, 8),
+	}, []string{"type"})
+
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "decap_cache_requests_total",
+		Help: "Requests executed with the result cache, by cache status (HIT, MISS or BYPASS).",
+	}, []string{"status"})
+)
+
+var (
+	windowsDesc = prometheus.NewDesc("decap_windows",
+		"Open window sessions.", nil, nil)
+	tabsDesc = prometheus.NewDesc("decap_tabs",
+		"Tabs by state (active or saved).", []string{"state"}, nil)
+	queueDesc = prometheus.NewDesc("decap_queue_length",
+		"Requests waiting for a window or tab slot.", []string{"slot"}, nil)
+	chromeMemoryDesc = prometheus.NewDesc("decap_chrome_memory_bytes",
+		"Resident memory of the locally launched Chrome processes, including their child processes.", nil, nil)
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, actionDuration, listenWait,
+		windowEvictions, artifactBytes, cacheRequests)
+}
+
+// StateCollector reports the allocator's state at scrape time. Collecting
+// blocks until AllocateSessions is running.
+type StateCollector struct{}
+
+func (StateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- windowsDesc
+	ch <- tabsDesc
+	ch <- queueDesc
+	ch <- chromeMemoryDesc
+}
+
+func (StateCollector) Collect(ch chan<- prometheus.Metric) {
+	st := CurrentStats()
+	ch <- prometheus.MustNewConstMetric(windowsDesc, prometheus.GaugeValue, float64(st.Windows))
+	ch <- prometheus.MustNewConstMetric(tabsDesc, prometheus.GaugeValue, float64(st.ActiveTabs), "active")
+	ch <- prometheus.MustNewConstMetric(tabsDesc, prometheus.GaugeValue, float64(st.SavedTabs), "saved")
+	ch <- prometheus.MustNewConstMetric(queueDesc, prometheus.GaugeValue, float64(st.WindowQueue), "window")
+	ch <- prometheus.MustNewConstMetric(queueDesc, prometheus.GaugeValue, float64(st.TabQueue), "tab")
+
+	if mem, err := chromeMemory(); err == nil {
+		ch <- prometheus.MustNewConstMetric(chromeMemoryDesc, prometheus.GaugeValue, float64(mem))
+	}
+}
+
+// outcome classifies the result of Execute for decap_requests_total.
+func outcome(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, ErrOverloaded):
+		return "overloaded"
+	case errors.Is(err, ErrShutdown):
+		return "shutdown"
+	case errors.Is(err, ErrBrowserCrashed):
+		return "crashed"
+	default:
+		return "error"
+	}
+}
+
+// chromeMemory sums the resident memory of the Chrome processes launched by
+// decap and their descendants. It only works on Linux.
+func chromeMemory() (int64, error) {
+	browserQuery <- struct{}{}
+	refs := <-browserReply
+	roots := make(map[int]bool)
+	for _, ref := range refs {
+		c := chromedp.FromContext(ref.ctx)
+		if c != nil && c.Browser != nil && c.Browser.Process() != nil {
+			roots[c.Browser.Process().Pid] = true
+		}
+	}
+	if len(roots) == 0 {
+		return 0, nil
+	}
+
+	statuses, err := filepath.Glob("/proc/[0-9]*/status")
+	if err != nil || len(statuses) == 0 {
+		return 0, fmt.Errorf("couldn't list processes")
+	}
+	parents := make(map[int]int)
+	rss := make(map[int]int64)
+	for _, path := range statuses {
+		pid, ppid, mem, err := procStatus(path)
+		if err != nil {
+			continue
+		}
+		parents[pid] = ppid
+		rss[pid] = mem
+	}
+	var total int64
+	for pid, mem := range rss {
+		for p := pid; p > 1; p = parents[p] {
+			if roots[p] {
+				total += mem
+				break
+			}
+		}
+	}
+	return total, nil
+}
+
+func procStatus(path string) (pid, ppid int, rss int64, err error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	s := bufio.NewScanner(bytes.NewReader(buf))
+	for s.Scan() {
+		key, value, ok := strings.Cut(s.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		switch key {
+		case "Pid":
+			pid, _ = strconv.Atoi(fields[0])
+		case "PPid":
+			ppid, _ = strconv.Atoi(fields[0])
+		case "VmRSS":
+			kb, _ := strconv.ParseInt(fields[0], 10, 64)
+			rss = kb << 10
+		}
+	}
+	return pid, ppid, rss, nil
+}
@@ -0,0 +1,243 @@
+package decap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/fetch"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+)
+
+// A URLPolicy restricts which URLs requests can navigate to and load
+// resources from. The zero value allows everything.
+type URLPolicy struct {
+	// Schemes lists the URL schemes that navigate accepts. Empty means any.
+	Schemes []string
+	// AllowHosts and DenyHosts are globs (e.g. "*.example.com") matched
+	// against host names. If AllowHosts is non-empty, other hosts are denied.
+	// DenyHosts takes precedence.
+	AllowHosts []string
+	DenyHosts  []string
+	// BlockPrivate denies hosts that resolve to loopback, private,
+	// link-local or otherwise non-public addresses.
+	BlockPrivate bool
+
+	once       sync.Once
+	allowHosts []*regexp.Regexp
+	denyHosts  []*regexp.Regexp
+	err        error
+}
+
+// Policy is applied to the navigate actions of all requests and to every
+// request the browsers make, including redirects, subresources and the
+// requests of popups, out-of-process iframes and workers.
+var Policy URLPolicy
+
+const (
+	// policyDNSCacheTTL is how long host name lookups are cached for the
+	// private address check.
+	policyDNSCacheTTL = time.Minute
+	// policyDNSCacheSize is the number of hosts the cache holds before
+	// entries are evicted.
+	policyDNSCacheSize = 4096
+)
+
+var policyDNSCache = struct {
+	sync.Mutex
+	entries map[string]policyDNSEntry
+}{entries: make(map[string]policyDNSEntry)}
+
+type policyDNSEntry struct {
+	private bool
+	expires time.Time
+}
+
+// Validate compiles the host globs of the policy.
+func (p *URLPolicy) Validate() error {
+	p.once.Do(func() {
+		for _, glob := range p.AllowHosts {
+			re, err := compileURLPattern(strings.ToLower(glob))
+			if err != nil {
+				p.err = fmt.Errorf(`allowed host "%s": %s`, glob, err)
+				return
+			}
+			p.allowHosts = append(p.allowHosts, re)
+		}
+		for _, glob := range p.DenyHosts {
+			re, err := compileURLPattern(strings.ToLower(glob))
+			if err != nil {
+				p.err = fmt.Errorf(`denied host "%s": %s`, glob, err)
+				return
+			}
+			p.denyHosts = append(p.denyHosts, re)
+		}
+	})
+	return p.err
+}
+
+func (p *URLPolicy) restrictsHosts() bool {
+	return len(p.AllowHosts) > 0 || len(p.DenyHosts) > 0 || p.BlockPrivate
+}
+
+// checkNavigation checks a URL given to navigate.
+func (p *URLPolicy) checkNavigation(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if len(p.Schemes) > 0 {
+		allowed := false
+		for _, scheme := range p.Schemes {
+			allowed = allowed || strings.EqualFold(scheme, u.Scheme)
+		}
+		if !allowed {
+			return fmt.Errorf(`URL scheme "%s" is not allowed`, u.Scheme)
+		}
+	}
+	return p.checkHost(u)
+}
+
+// checkHost checks the host of a network URL against the host globs and, if
+// enabled, the private address ranges.
+func (p *URLPolicy) checkHost(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil
+	}
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, re := range p.denyHosts {
+		if re.MatchString(host) {
+			return fmt.Errorf(`host "%s" is denied`, host)
+		}
+	}
+	if len(p.allowHosts) > 0 {
+		allowed := false
+		for _, re := range p.allowHosts {
+			allowed = allowed || re.MatchString(host)
+		}
+		if !allowed {
+			return fmt.Errorf(`host "%s" is not allowed`, host)
+		}
+	}
+	if p.BlockPrivate {
+		private, err := resolvesPrivate(host)
+		if err != nil {
+			return err
+		}
+		if private {
+			return fmt.Errorf(`host "%s" has a non-public address`, host)
+		}
+	}
+	return nil
+}
+
+// resolvesPrivate reports whether host is, or resolves to, a non-public
+// address. Chrome resolves the host again itself, so this doesn't protect
+// against DNS rebinding with very short TTLs.
+func resolvesPrivate(host string) (bool, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return privateIP(ip), nil
+	}
+	policyDNSCache.Lock()
+	entry, ok := policyDNSCache.entries[host]
+	if ok && !time.Now().Before(entry.expires) {
+		delete(policyDNSCache.entries, host)
+		ok = false
+	}
+	policyDNSCache.Unlock()
+	if ok {
+		return entry.private, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return false, fmt.Errorf(`couldn't resolve host "%s": %s`, host, err)
+	}
+	private := false
+	for _, addr := range addrs {
+		private = private || privateIP(addr.IP)
+	}
+	cachePrivate(host, private)
+	return private, nil
+}
+
+// cachePrivate records the result of the private address check for host,
+// evicting expired entries, or arbitrary ones if none have expired, when the
+// cache is full.
+func cachePrivate(host string, private bool) {
+	policyDNSCache.Lock()
+	defer policyDNSCache.Unlock()
+	now := time.Now()
+	if len(policyDNSCache.entries) >= policyDNSCacheSize {
+		for h, e := range policyDNSCache.entries {
+			if !now.Before(e.expires) {
+				delete(policyDNSCache.entries, h)
+			}
+		}
+	}
+	for h := range policyDNSCache.entries {
+		if len(policyDNSCache.entries) < policyDNSCacheSize {
+			break
+		}
+		delete(policyDNSCache.entries, h)
+	}
+	policyDNSCache.entries[host] = policyDNSEntry{private, now.Add(policyDNSCacheTTL)}
+}
+
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func privateIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || sharedAddressSpace.Contains(ip)
+}
+
+// enforce makes the browser of ctx fail the requests that the policy denies.
+// Fetch is enabled on the browser target rather than on the pages, since
+// popups, out-of-process iframes and workers are targets of their own, whose
+// requests the Fetch domain of a page doesn't see.
+func (p *URLPolicy) enforce(ctx context.Context) error {
+	if !p.restrictsHosts() {
+		return nil
+	}
+	bctx := cdp.WithExecutor(ctx, chromedp.FromContext(ctx).Browser)
+	chromedp.ListenBrowser(ctx, func(ev interface{}) {
+		if ev, ok := ev.(*fetch.EventRequestPaused); ok {
+			go func() {
+				if err := p.resolve(ev).Do(bctx); err != nil && bctx.Err() == nil {
+					Logger.Warn("Fetch interception failed", "url", ev.Request.URL, "err", err)
+				}
+			}()
+		}
+	})
+	if err := fetch.Enable().Do(bctx); err != nil {
+		return fmt.Errorf("couldn't enforce URL policy: %s", err)
+	}
+	return nil
+}
+
+// resolve fails the request if the policy denies it and continues it
+// otherwise.
+func (p *URLPolicy) resolve(ev *fetch.EventRequestPaused) chromedp.Action {
+	u, err := url.Parse(ev.Request.URL)
+	if err == nil {
+		err = p.checkHost(u)
+	}
+	if err == nil {
+		return fetch.ContinueRequest(ev.RequestID)
+	}
+	Logger.Warn("Request denied by URL policy", "url", ev.Request.URL, "err", err)
+	return fetch.FailRequest(ev.RequestID, network.ErrorReasonAccessDenied)
+}
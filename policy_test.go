@@ -0,0 +1,164 @@
+package decap
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chromedp/cdproto/fetch"
+	"github.com/chromedp/cdproto/network"
+)
+
+func TestURLPolicyCheckNavigation(t *testing.T) {
+	p := &URLPolicy{
+		Schemes:    []string{"https"},
+		AllowHosts: []string{"*.example.com"},
+		DenyHosts:  []string{"admin.example.com"},
+	}
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://www.example.com/", true},
+		{"https://WWW.Example.com/", true},
+		{"http://www.example.com/", false},
+		{"https://admin.example.com/", false},
+		{"https://example.org/", false},
+	}
+	for _, tt := range tests {
+		err := p.checkNavigation(tt.url)
+		if (err == nil) != tt.allowed {
+			t.Errorf("%s: err = %v, want allowed %t", tt.url, err, tt.allowed)
+		}
+	}
+}
+
+func TestURLPolicyBlockPrivate(t *testing.T) {
+	// IP literals aren't resolved, so the test needs no DNS
+	p := &URLPolicy{BlockPrivate: true}
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://93.184.215.14/", true},
+		{"https://127.0.0.1/", false},
+		{"https://10.1.2.3/", false},
+		{"https://100.64.0.1/", false},
+		{"https://169.254.169.254/latest/meta-data/", false},
+		{"https://[::1]/", false},
+		{"https://[fe80::1]/", false},
+		{"file:///etc/passwd", true},
+	}
+	for _, tt := range tests {
+		err := p.checkNavigation(tt.url)
+		if (err == nil) != tt.allowed {
+			t.Errorf("%s: err = %v, want allowed %t", tt.url, err, tt.allowed)
+		}
+	}
+}
+
+func TestURLPolicyInvalidGlob(t *testing.T) {
+	p := &URLPolicy{DenyHosts: []string{"/(/"}}
+	if err := p.Validate(); err == nil {
+		t.Error("Validate accepted an invalid host pattern")
+	}
+}
+
+func TestURLPolicyResolve(t *testing.T) {
+	p := &URLPolicy{DenyHosts: []string{"tracker.test"}}
+	if _, ok := p.resolve(pausedRequest("https://decap.test/", nil)).(*fetch.ContinueRequestParams); !ok {
+		t.Error("allowed request wasn't continued")
+	}
+	fail, ok := p.resolve(pausedRequest("https://tracker.test/pixel.gif", nil)).(*fetch.FailRequestParams)
+	if !ok {
+		t.Fatal("denied request wasn't failed")
+	}
+	if fail.ErrorReason != network.ErrorReasonAccessDenied {
+		t.Errorf("error reason = %s, want AccessDenied", fail.ErrorReason)
+	}
+}
+
+func TestPolicyDNSCacheIsBounded(t *testing.T) {
+	defer func() {
+		policyDNSCache.Lock()
+		policyDNSCache.entries = make(map[string]policyDNSEntry)
+		policyDNSCache.Unlock()
+	}()
+	policyDNSCache.Lock()
+	policyDNSCache.entries["expired.test"] = policyDNSEntry{true, time.Now().Add(-time.Second)}
+	policyDNSCache.Unlock()
+	for i := 0; i < policyDNSCacheSize+10; i++ {
+		cachePrivate(fmt.Sprintf("host%d.test", i), false)
+	}
+	policyDNSCache.Lock()
+	n := len(policyDNSCache.entries)
+	_, expired := policyDNSCache.entries["expired.test"]
+	policyDNSCache.Unlock()
+	if n > policyDNSCacheSize {
+		t.Errorf("cache holds %d hosts, want at most %d", n, policyDNSCacheSize)
+	}
+	if expired {
+		t.Error("expired entry wasn't evicted")
+	}
+}
+
+// TestPolicyDeniesChildTargets checks that the requests of out-of-process
+// iframes and popups are denied, not just those of the page. The page is
+// served from 127.0.0.1 and embeds localhost, which is another site, so the
+// iframe gets a process and target of its own.
+func TestPolicyDeniesChildTargets(t *testing.T) {
+	startBrowser(t)
+	var page string
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		hits[req.URL.Path]++
+		body := page
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		if req.URL.Path == "/" {
+			fmt.Fprint(w, body)
+		}
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	mu.Lock()
+	page = fmt.Sprintf(`<iframe src="http://localhost:%s/frame"></iframe>
+<script>window.open("http://localhost:%[1]s/popup")</script>`, port)
+	mu.Unlock()
+
+	Policy = URLPolicy{DenyHosts: []string{"localhost"}}
+	defer func() { Policy = URLPolicy{} }()
+	// the policy is enforced when a browser starts, so use a browser of
+	// its own
+	Launch.Profiles = map[string]LaunchProfile{"policy-test": {}}
+	defer func() { Launch.Profiles = nil }()
+
+	r := mustParse(t, `{
+		"global_render_delay": "0s",
+		"timeout": "20s",
+		"browser_profile": "policy-test",
+		"query": [{"actions": [
+			["navigate", "`+srv.URL+`/"],
+			["listen", "load"],
+			["sleep", "1s"],
+			["eval", "1"]
+		]}]
+	}`)
+	if _, err := r.Execute(); err != nil {
+		t.Fatalf("Execute: %s", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if hits["/"] == 0 {
+		t.Error("page wasn't loaded")
+	}
+	if hits["/frame"] != 0 || hits["/popup"] != 0 {
+		t.Errorf("denied host got requests: %v", hits)
+	}
+}
@@ -0,0 +1,114 @@
+package decap
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/chromedp/chromedp"
+)
+
+// ProfileDir is the directory under which persistent profiles keep their
+// Chrome user data directories. Persistent profiles are disabled if it's
+// empty.
+var ProfileDir string
+
+var profileNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+func validProfileName(name string) error {
+	switch {
+	case ProfileDir == "":
+		return fmt.Errorf("persistent profiles are not enabled")
+	case len(RemoteBrowsers) > 0:
+		return fmt.Errorf("persistent profiles can't be used with remote browsers")
+	case !profileNameRegexp.MatchString(name):
+		return fmt.Errorf(`invalid profile name "%s"`, name)
+	}
+	return nil
+}
+
+func profileUserDataDir(name string) string {
+	return filepath.Join(ProfileDir, name)
+}
+
+// profileWindow returns the window that has the persistent profile open, if
+// any. A profile's user data directory can only be used by one browser at a
+// time, so all requests for the profile share this window.
+func profileWindow(name string, windows map[string]session) (session, bool) {
+	if name == "" {
+		return session{}, false
+	}
+	for _, w := range windows {
+		if w.spec.userProfile == name {
+			return w, true
+		}
+	}
+	return session{}, false
+}
+
+// profileClosing maps the persistent profiles whose browsers are being
+// closed to channels that are closed once Chrome has exited. A new browser
+// can't use the profile's user data directory until then.
+var profileClosing = struct {
+	sync.Mutex
+	done map[string]chan struct{}
+}{done: make(map[string]chan struct{})}
+
+// closeGracefully returns a cancel function that closes the browser of a
+// persistent profile window with Browser.close, so that Chrome gets to write
+// cookies and other state to disk, before killing it. It closes the browser in
+// the background, since it's called from AllocateSessions, and marks the
+// profile as closing until Chrome has exited.
+func closeGracefully(ctx context.Context, name string, allocCancel context.CancelFunc) context.CancelFunc {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			done := make(chan struct{})
+			profileClosing.Lock()
+			profileClosing.done[name] = done
+			profileClosing.Unlock()
+			go func() {
+				tctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+				defer cancel()
+				if err := chromedp.Cancel(tctx); err != nil {
+					Logger.Warn("Couldn't close profile browser gracefully", "profile", name, "err", err)
+				}
+				// waits for Chrome to exit
+				allocCancel()
+				profileClosing.Lock()
+				if profileClosing.done[name] == done {
+					delete(profileClosing.done, name)
+				}
+				profileClosing.Unlock()
+				close(done)
+			}()
+		})
+	}
+}
+
+// profileBusy reports whether the browser of the persistent profile is still
+// being closed.
+func profileBusy(name string) bool {
+	profileClosing.Lock()
+	defer profileClosing.Unlock()
+	return profileClosing.done[name] != nil
+}
+
+// waitForProfile waits until the browser of the persistent profile has
+// exited, or of all persistent profiles if name is empty.
+func waitForProfile(name string) {
+	profileClosing.Lock()
+	var done []chan struct{}
+	for n, ch := range profileClosing.done {
+		if name == "" || n == name {
+			done = append(done, ch)
+		}
+	}
+	profileClosing.Unlock()
+	for _, ch := range done {
+		<-ch
+	}
+}
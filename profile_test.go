@@ -0,0 +1,53 @@
+package decap
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCloseGracefullyDoesNotBlock(t *testing.T) {
+	exit := make(chan struct{})
+	calls := 0
+	cancel := closeGracefully(context.Background(), "test-profile", func() {
+		calls++
+		<-exit // Chrome is slow to exit
+	})
+
+	returned := make(chan struct{})
+	go func() {
+		cancel()
+		cancel()
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("cancel blocked until the browser exited")
+	}
+	if !profileBusy("test-profile") {
+		t.Error("profile isn't busy while its browser is closing")
+	}
+	if profileBusy("other-profile") {
+		t.Error("other profile is busy")
+	}
+
+	waited := make(chan struct{})
+	go func() {
+		waitForProfile("test-profile")
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("waitForProfile returned before the browser exited")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(exit)
+	<-waited
+	if profileBusy("test-profile") {
+		t.Error("profile is still busy after its browser exited")
+	}
+	if calls != 1 {
+		t.Errorf("browser was closed %d times, want once", calls)
+	}
+}
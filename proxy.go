@@ -0,0 +1,48 @@
+package decap
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/chromedp/cdproto/fetch"
+)
+
+// parseProxyURL splits a proxy URL into the proxy server passed to Chrome and
+// the credentials embedded in it, if any.
+func parseProxyURL(rawURL string) (server, username, password string, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", "", err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks4", "socks5":
+	default:
+		return "", "", "", fmt.Errorf(`unsupported proxy scheme "%s"`, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return "", "", "", fmt.Errorf("proxy host is missing")
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return "", "", "", fmt.Errorf("proxy URL can't have a path or query")
+	}
+	if u.User != nil {
+		username = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	return fmt.Sprintf("%s://%s", u.Scheme, u.Host), username, password, nil
+}
+
+// answerAuth responds to an authentication challenge paused by the Fetch
+// domain. Proxy challenges are answered with the interceptor's proxy
+// credentials, while challenges from servers get Chrome's default handling.
+func (ic *interceptor) answerAuth(ctx context.Context, ev *fetch.EventAuthRequired) {
+	resp := &fetch.AuthChallengeResponse{Response: fetch.AuthChallengeResponseResponseDefault}
+	if ic.proxyAuth != nil && ev.AuthChallenge.Source == fetch.AuthChallengeSourceProxy {
+		resp = ic.proxyAuth
+	}
+	err := fetch.ContinueWithAuth(ev.RequestID, resp).Do(ctx)
+	if err != nil && ctx.Err() == nil {
+		ic.logger().Warn("Proxy authentication failed", "url", ev.Request.URL, "err", err)
+	}
+}
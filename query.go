@@ -1,25 +1,34 @@
 package decap
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/url"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/fetch"
 	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/page"
 	"github.com/chromedp/chromedp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-const (
+var (
+	// MaxRenderDelay and MaxTimeout cap the global_render_delay and timeout
+	// of requests.
 	MaxRenderDelay = 10 * time.Second
 	MaxTimeout     = 120 * time.Second
-)
+	// DefaultTimeout is the timeout of requests that don't set one.
+	DefaultTimeout = 20 * time.Second
 
-var (
 	DefaultPageloadEvents = []string{
 		"DOMContentLoaded",
 		"firstMeaningfulPaint",
@@ -29,12 +38,14 @@ var (
 )
 
 type Result struct {
-	Err      []string   `json:"err"`
-	Out      [][]string `json:"out"`
-	TabID    string     `json:"tab_id"`
-	WindowID string     `json:"window_id"`
-	img      []byte
-	pdf      []byte
+	ArtifactURL string         `json:"artifact_url,omitempty"`
+	Blocked     map[string]int `json:"blocked,omitempty"`
+	Err         []string       `json:"err"`
+	Out         [][]string     `json:"out"`
+	TabID       string         `json:"tab_id"`
+	WindowID    string         `json:"window_id"`
+	img         []byte
+	pdf         []byte
 }
 
 func (res *Result) Type() string {
@@ -56,6 +67,19 @@ func (res *Result) PDFBuffer() []byte {
 	return res.pdf
 }
 
+type OriginStorage struct {
+	Origin         string               `json:"origin"`
+	LocalStorage   []*StorageItem       `json:"localStorage"`
+	SessionStorage []*StorageItem       `json:"sessionStorage"`
+	IndexedDB      []*IndexedDBDatabase `json:"indexedDB"`
+}
+
+type ProxyBlock struct {
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
 type QueryBlock struct {
 	Actions    []Action `json:"actions"`
 	Repeat     *int     `json:"repeat"`
@@ -66,6 +90,61 @@ type QueryBlock struct {
 	pos        int
 }
 
+type BlockingBlock struct {
+	URLs          []string `json:"urls"`
+	ResourceTypes []string `json:"resource_types"`
+	ThirdParty    bool     `json:"third_party"`
+}
+
+type CookieBlock struct {
+	Name     string  `json:"name"`
+	Value    string  `json:"value"`
+	URL      string  `json:"url"`
+	Domain   string  `json:"domain"`
+	Path     string  `json:"path"`
+	Expires  float64 `json:"expires"`
+	HTTPOnly bool    `json:"httpOnly"`
+	Secure   bool    `json:"secure"`
+	SameSite string  `json:"sameSite"`
+}
+
+type IndexedDBDatabase struct {
+	Name    string            `json:"name"`
+	Version int               `json:"version"`
+	Stores  []*IndexedDBStore `json:"stores"`
+}
+
+type IndexedDBStore struct {
+	Name          string             `json:"name"`
+	KeyPath       interface{}        `json:"keyPath"`
+	AutoIncrement bool               `json:"autoIncrement"`
+	Records       []*IndexedDBRecord `json:"records"`
+}
+
+type IndexedDBRecord struct {
+	Key   interface{} `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+type InterceptBlock struct {
+	URL      string            `json:"url"`
+	Action   string            `json:"action"`
+	Status   int               `json:"status"`
+	Body     string            `json:"body"`
+	Headers  map[string]string `json:"headers"`
+	Location string            `json:"location"`
+}
+
+type StorageItem struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type StorageState struct {
+	Cookies []*CookieBlock   `json:"cookies"`
+	Origins []*OriginStorage `json:"origins"`
+}
+
 type ViewportBlock struct {
 	Width       int      `json:"width"`
 	Height      int      `json:"height"`
@@ -75,33 +154,89 @@ type ViewportBlock struct {
 }
 
 type Request struct {
-	Query            []*QueryBlock  `json:"query"`
-	EmulateViewport  *ViewportBlock `json:"emulate_viewport"`
-	ForwardUserAgent bool           `json:"forward_user_agent"`
-	RenderDelay      string         `json:"global_render_delay"`
-	ReuseTab         bool           `json:"reuse_tab"`
-	ReuseWindow      bool           `json:"reuse_window"`
-	SessionID        string         `json:"sessionid"`
-	Timeout          string         `json:"timeout"`
+	Query            []*QueryBlock     `json:"query"`
+	ArtifactURL      bool              `json:"artifact_url"`
+	Block            *BlockingBlock    `json:"block"`
+	BrowserProfile   string            `json:"browser_profile"`
+	Cookies          []*CookieBlock    `json:"cookies"`
+	EmulateViewport  *ViewportBlock    `json:"emulate_viewport"`
+	ExtraHeaders     map[string]string `json:"extra_headers"`
+	FilterLists      []string          `json:"filter_lists"`
+	ForwardUserAgent bool              `json:"forward_user_agent"`
+	Intercept        []*InterceptBlock `json:"intercept"`
+	Profile          string            `json:"profile"`
+	Proxy            *ProxyBlock       `json:"proxy"`
+	RenderDelay      string            `json:"global_render_delay"`
+	RetryOnCrash     bool              `json:"retry_on_crash"`
+	ReuseTab         bool              `json:"reuse_tab"`
+	ReuseWindow      bool              `json:"reuse_window"`
+	SessionID        string            `json:"sessionid"`
+	StorageState     *StorageState     `json:"storage_state"`
+	Timeout          string            `json:"timeout"`
+	cookies          []*network.CookieParam
+	storageCookies   []*network.CookieParam
+	hidingScript     string
+	hidingScriptID   page.ScriptIdentifier
+	id               string
+	interceptor      *interceptor
+	maxRenderDelay   time.Duration
+	maxTimeout       time.Duration
 	oldTabID         string
+	owner            string
 	pos              int
 	renderDelay      time.Duration
 	res              Result
+	spec             windowSpec
 	timeout          time.Duration
+	traceCtx         context.Context
 }
 
 func (r *Request) Execute() (*Result, error) {
-	var tab session
+	return r.ExecuteContext(context.Background())
+}
 
-	if r.newTab() {
-		window := loadWindow(r.SessionID, r.timeout)
-		r.SessionID = window.id
-		tab = window.createSiblingTabWithTimeout(r.timeout)
-	} else {
-		tab = loadTab(r.oldTabID)
-		if tab.id != r.oldTabID {
-			return nil, fmt.Errorf("tab with id \"%s\" doesn't exist", r.oldTabID)
-		}
+// ExecuteContext is like Execute, but traces the request as a child of the
+// span in ctx. Cancelling ctx doesn't stop the request; use timeout instead.
+func (r *Request) ExecuteContext(ctx context.Context) (res *Result, err error) {
+	defer func() { requestsTotal.WithLabelValues(outcome(err)).Inc() }()
+	// fix the ID before actions start logging from other goroutines
+	r.ID()
+
+	r.traceCtx = ctx
+	var span trace.Span
+	r.traceCtx, span = r.startSpan("decap.Execute", attribute.String("decap.request_id", r.ID()))
+	defer func() {
+		span.SetAttributes(attribute.String("decap.session", r.SessionID))
+		endSpan(span, err)
+	}()
+
+	_, queueSpan := r.startSpan("decap.queue")
+	err = tabSlots.acquire(MaxQueueWait)
+	endSpan(queueSpan, err)
+	if err != nil {
+		return nil, err
+	}
+	defer tabSlots.release()
+
+	sessionID := r.SessionID
+	res, err = r.execute()
+	if errors.Is(err, ErrBrowserCrashed) && r.RetryOnCrash && r.newTab() {
+		r.log().Warn("Retrying query after crash", "err", err)
+		evictCrashedWindow(r.SessionID)
+		r.SessionID = sessionID
+		r.resetResult()
+		res, err = r.execute()
+	}
+	return res, err
+}
+
+func (r *Request) execute() (*Result, error) {
+	tab, err := r.openTab()
+	if err != nil {
+		return nil, err
+	}
+	if r.interceptor != nil {
+		r.interceptor.log = r.log()
 	}
 	if r.ReuseWindow {
 		r.res.WindowID = r.SessionID
@@ -112,32 +247,108 @@ func (r *Request) Execute() (*Result, error) {
 	} else {
 		defer tab.shutdown()
 	}
+	defer r.interceptor.disable(tab.ctx)
+	defer r.removeHidingScript(tab.ctx)
 
-	var err error
 	var block *QueryBlock
 	for r.pos, block = range r.Query {
 
-		fmt.Fprintf(os.Stderr, "%s Query %d/%d (session %s)\n",
-			time.Now().Format("[15:04:05]"), r.pos+1, len(r.Query), r.SessionID)
+		r.log().Info("Query", "block", r.pos+1, "blocks", len(r.Query))
 
 		for i := 0; i < *block.Repeat; i++ {
-			err = block.cdpWhile.Do(tab.ctx)
+			done, err := r.runBlock(tab, block, i)
 			if err != nil {
-				return nil, err
+				return nil, tab.crashError(err)
 			}
-			if !block.cont {
+			if done {
 				break
 			}
-			err = chromedp.Run(tab.ctx, block.cdpActions...)
-			if err != nil {
-				return nil, err
-			}
 		}
 	}
 
+	r.res.Blocked = r.interceptor.blockedCounts()
+	if len(r.res.img) > 0 {
+		artifactBytes.WithLabelValues("png").Observe(float64(len(r.res.img)))
+	}
+	if len(r.res.pdf) > 0 {
+		artifactBytes.WithLabelValues("pdf").Observe(float64(len(r.res.pdf)))
+	}
+	if r.ArtifactURL {
+		if err = r.storeArtifact(); err != nil {
+			return nil, err
+		}
+	}
 	return &r.res, nil
 }
 
+// openTab opens a new tab, takes a warm one or loads a saved one, depending on
+// the request.
+func (r *Request) openTab() (tab session, err error) {
+	_, span := r.startSpan("decap.open_tab")
+	defer func() { endSpan(span, err) }()
+
+	var warm bool
+	if r.newTab() && r.SessionID == "" && !r.ReuseWindow && !r.ReuseTab && r.spec == (windowSpec{}) {
+		tab, warm = checkoutWarmTab(r.timeout)
+	}
+	span.SetAttributes(attribute.Bool("decap.warm", warm))
+
+	switch {
+	case warm:
+		r.SessionID, _, _ = parseTabID(tab.id)
+	case r.newTab():
+		window := loadWindow(r.SessionID, r.spec, r.owner, r.timeout)
+		if window.err != nil {
+			return tab, window.err
+		}
+		r.SessionID = window.id
+		tab = window.createSiblingTabWithTimeout(r.timeout)
+	default:
+		tab = loadTab(r.oldTabID, r.owner)
+		if tab.id != r.oldTabID {
+			return tab, fmt.Errorf("tab with id \"%s\" doesn't exist", r.oldTabID)
+		}
+	}
+	return tab, nil
+}
+
+// runBlock runs one iteration of a query block. It reports done when the
+// block's while condition no longer holds.
+func (r *Request) runBlock(tab session, block *QueryBlock, iteration int) (done bool, err error) {
+	parent := r.traceCtx
+	var span trace.Span
+	r.traceCtx, span = r.startSpan("decap.block",
+		attribute.Int("decap.block", r.pos), attribute.Int("decap.iteration", iteration))
+	defer func() {
+		endSpan(span, err)
+		r.traceCtx = parent
+	}()
+
+	if err = block.cdpWhile.Do(tab.ctx); err != nil {
+		return true, err
+	}
+	if !block.cont {
+		return true, nil
+	}
+	return false, chromedp.Run(tab.ctx, block.cdpActions...)
+}
+
+// resetResult discards the output of a failed execution, so that the request
+// can be executed again in a new tab.
+func (r *Request) resetResult() {
+	for i := range r.res.Out {
+		r.res.Out[i] = r.res.Out[i][:0]
+	}
+	r.res.img = nil
+	r.res.pdf = nil
+	r.res.ArtifactURL = ""
+	r.res.TabID = ""
+	r.res.WindowID = ""
+	if r.interceptor != nil {
+		r.interceptor.reset()
+	}
+}
+
 func (r *Request) ParseRequest(body io.Reader) error {
 	err := json.NewDecoder(body).Decode(&r)
 	if err != nil {
@@ -148,6 +359,46 @@ func (r *Request) ParseRequest(body io.Reader) error {
 		return fmt.Errorf("value \"true\" is not supported for init.forward_user_agent")
 	}
 
+	err = r.parseBrowserProfile()
+	if err != nil {
+		return err
+	}
+	err = r.parseProfile()
+	if err != nil {
+		return err
+	}
+	err = r.parseProxy()
+	if err != nil {
+		return err
+	}
+	err = r.parseCookies()
+	if err != nil {
+		return err
+	}
+	err = r.parseStorageState()
+	if err != nil {
+		return err
+	}
+	err = r.parseExtraHeaders()
+	if err != nil {
+		return err
+	}
+	err = r.parsePolicy()
+	if err != nil {
+		return err
+	}
+	err = r.parseIntercept()
+	if err != nil {
+		return err
+	}
+	err = r.parseBlock()
+	if err != nil {
+		return err
+	}
+	err = r.parseFilterLists()
+	if err != nil {
+		return err
+	}
 	err = r.parseEmulateViewport()
 	if err != nil {
 		return err
@@ -160,6 +411,10 @@ func (r *Request) ParseRequest(body io.Reader) error {
 	if err != nil {
 		return err
 	}
+	err = r.parseArtifactURL()
+	if err != nil {
+		return err
+	}
 	err = r.parseQueryBlocks()
 	if err != nil {
 		return err
@@ -167,6 +422,263 @@ func (r *Request) ParseRequest(body io.Reader) error {
 	return nil
 }
 
+func (r *Request) parseBrowserProfile() error {
+	if r.BrowserProfile == "" {
+		return nil
+	}
+	if len(RemoteBrowsers) > 0 {
+		return fmt.Errorf("browser_profile can't be used with remote browsers")
+	}
+	if !validLaunchProfile(r.BrowserProfile) {
+		return fmt.Errorf(`browser_profile: unknown profile "%s"`, r.BrowserProfile)
+	}
+	r.spec.profile = r.BrowserProfile
+	return nil
+}
+
+func (r *Request) parseProfile() error {
+	if r.Profile == "" {
+		return nil
+	}
+	if err := validProfileName(r.Profile); err != nil {
+		return fmt.Errorf("profile: %s", err)
+	}
+	r.spec.userProfile = r.Profile
+	return nil
+}
+
+func (r *Request) parseProxy() error {
+	if r.Proxy == nil {
+		return nil
+	}
+	server, username, password, err := parseProxyURL(r.Proxy.URL)
+	if err != nil {
+		return fmt.Errorf("proxy.url: %s", err)
+	}
+	if r.Proxy.Username != "" {
+		username, password = r.Proxy.Username, r.Proxy.Password
+	}
+	r.spec.proxy = server
+	if username == "" {
+		return nil
+	}
+	if strings.HasPrefix(server, "socks") {
+		return fmt.Errorf("proxy: Chrome doesn't support authentication with SOCKS proxies")
+	}
+	r.spec.proxyUser = username
+	r.fetchInterceptor().proxyAuth = &fetch.AuthChallengeResponse{
+		Response: fetch.AuthChallengeResponseResponseProvideCredentials,
+		Username: username,
+		Password: password,
+	}
+	return nil
+}
+
+func (r *Request) parseCookies() error {
+	var err error
+	r.cookies, err = parseCookieBlocks(r.Cookies)
+	if err != nil {
+		return fmt.Errorf("cookies%s", err)
+	}
+	return nil
+}
+
+func parseCookieBlocks(blocks []*CookieBlock) ([]*network.CookieParam, error) {
+	var cookies []*network.CookieParam
+	for i, c := range blocks {
+		switch {
+		case c == nil:
+			return nil, fmt.Errorf("[%d]: cookie can't be null", i)
+		case c.Name == "":
+			return nil, fmt.Errorf("[%d].name is empty or missing", i)
+		case c.URL == "" && c.Domain == "":
+			return nil, fmt.Errorf("[%d]: either url or domain must be set", i)
+		}
+		cookie := &network.CookieParam{
+			Name:     c.Name,
+			Value:    c.Value,
+			URL:      c.URL,
+			Domain:   c.Domain,
+			Path:     c.Path,
+			HTTPOnly: c.HTTPOnly,
+			Secure:   c.Secure,
+		}
+		if c.URL != "" {
+			if _, err := url.ParseRequestURI(c.URL); err != nil {
+				return nil, fmt.Errorf("[%d].url: %s", i, err)
+			}
+		}
+		if c.Expires > 0 {
+			sec, frac := math.Modf(c.Expires)
+			expires := cdp.TimeSinceEpoch(time.Unix(int64(sec), int64(frac*1e9)))
+			cookie.Expires = &expires
+		}
+		switch c.SameSite {
+		case "":
+		case "Strict", "Lax", "None":
+			cookie.SameSite = network.CookieSameSite(c.SameSite)
+		default:
+			return nil, fmt.Errorf(`[%d].sameSite: unknown value "%s"`, i, c.SameSite)
+		}
+		cookies = append(cookies, cookie)
+	}
+	return cookies, nil
+}
+
+func (r *Request) parseStorageState() error {
+	if r.StorageState == nil {
+		return nil
+	}
+	if r.SessionID != "" {
+		return fmt.Errorf("storage_state is restored into a new window and can't be used with sessionid")
+	}
+	var err error
+	r.storageCookies, err = parseCookieBlocks(r.StorageState.Cookies)
+	if err != nil {
+		return fmt.Errorf("storage_state.cookies%s", err)
+	}
+	for i, o := range r.StorageState.Origins {
+		if o == nil {
+			return fmt.Errorf("storage_state.origins[%d]: origin can't be null", i)
+		}
+		u, err := url.Parse(o.Origin)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf(`storage_state.origins[%d].origin: invalid origin "%s"`, i, o.Origin)
+		}
+	}
+	return nil
+}
+
+func (r *Request) parseExtraHeaders() error {
+	if len(r.ExtraHeaders) == 0 {
+		return nil
+	}
+	for name := range r.ExtraHeaders {
+		if name == "" {
+			return fmt.Errorf("extra_headers: header name can't be empty")
+		}
+	}
+	r.fetchInterceptor().headers = r.ExtraHeaders
+	return nil
+}
+
+// parsePolicy checks that the URL policy is valid. The policy's host rules
+// are enforced by the browsers, see URLPolicy.enforce.
+func (r *Request) parsePolicy() error {
+	if err := Policy.Validate(); err != nil {
+		return fmt.Errorf("URL policy: %s", err)
+	}
+	return nil
+}
+
+func (r *Request) parseIntercept() error {
+	for i, block := range r.Intercept {
+		if block == nil {
+			return fmt.Errorf("intercept[%d]: rule can't be null", i)
+		}
+		if block.URL == "" {
+			return fmt.Errorf("intercept[%d].url is empty or missing", i)
+		}
+		re, err := compileURLPattern(block.URL)
+		if err != nil {
+			return fmt.Errorf("intercept[%d].url: %s", i, err)
+		}
+		rule := &interceptRule{
+			pattern:  re,
+			action:   block.Action,
+			status:   int64(block.Status),
+			body:     block.Body,
+			headers:  block.Headers,
+			location: block.Location,
+		}
+		switch block.Action {
+		case "fulfil":
+			if rule.status == 0 {
+				rule.status = 200
+			}
+		case "headers":
+			if len(block.Headers) == 0 {
+				return fmt.Errorf("intercept[%d].headers: must contain at least one header", i)
+			}
+		case "redirect":
+			if block.Location == "" {
+				return fmt.Errorf("intercept[%d].location is empty or missing", i)
+			}
+			if rule.status == 0 {
+				rule.status = 302
+			}
+		default:
+			return fmt.Errorf(`intercept[%d].action: unknown action "%s"`, i, block.Action)
+		}
+		if block.Action != "headers" && (rule.status < 100 || rule.status > 599) {
+			return fmt.Errorf("intercept[%d].status: invalid HTTP status %d", i, rule.status)
+		}
+		ic := r.fetchInterceptor()
+		ic.addHandler(func(ev *fetch.EventRequestPaused) chromedp.Action {
+			return rule.apply(ic, ev)
+		})
+	}
+	return nil
+}
+
+func (r *Request) parseBlock() error {
+	if r.Block == nil {
+		return nil
+	}
+	rules := &blockRules{
+		resourceTypes: make(map[network.ResourceType]bool),
+		thirdParty:    r.Block.ThirdParty,
+	}
+	for i, pattern := range r.Block.URLs {
+		re, err := compileURLPattern(pattern)
+		if err != nil {
+			return fmt.Errorf("block.urls[%d]: %s", i, err)
+		}
+		rules.patterns = append(rules.patterns, re)
+	}
+	for i, name := range r.Block.ResourceTypes {
+		t, err := parseResourceType(name)
+		if err != nil {
+			return fmt.Errorf("block.resource_types[%d]: %s", i, err)
+		}
+		rules.resourceTypes[t] = true
+	}
+	ic := r.fetchInterceptor()
+	ic.addHandler(func(ev *fetch.EventRequestPaused) chromedp.Action {
+		if rules.match(ev) {
+			return ic.blockRequest(ev)
+		}
+		return nil
+	})
+	return nil
+}
+
+func (r *Request) parseFilterLists() error {
+	if len(r.FilterLists) == 0 {
+		return nil
+	}
+	var lists filterSet
+	for i, name := range r.FilterLists {
+		list, ok := lookupFilterList(name)
+		if !ok {
+			return fmt.Errorf(`filter_lists[%d]: unknown filter list "%s"`, i, name)
+		}
+		lists = append(lists, list)
+	}
+	ic := r.fetchInterceptor()
+	ic.addHandler(func(ev *fetch.EventRequestPaused) chromedp.Action {
+		if ev.ResourceType == network.ResourceTypeDocument && ev.FrameID == ic.mainFrame {
+			return nil
+		}
+		if lists.blocks(newFilterRequest(ev, ic.documentHost())) {
+			return ic.blockRequest(ev)
+		}
+		return nil
+	})
+	r.hidingScript = lists.hidingScript()
+	return nil
+}
+
 func (r *Request) parseEmulateViewport() error {
 	switch {
 	case r.EmulateViewport == nil:
@@ -211,29 +723,51 @@ func (r *Request) parseRenderDelay() error {
 	if err != nil {
 		return fmt.Errorf("invalid global_render_delay: %s", err)
 	}
-	if delay > MaxRenderDelay {
-		delay = MaxRenderDelay
+	if max := lowerLimit(r.maxRenderDelay, MaxRenderDelay); delay > max {
+		delay = max
 	}
 	r.renderDelay = delay
 	return nil
 }
 
 func (r *Request) parseTimeout() error {
-	if r.Timeout == "" {
-		r.timeout = 20 * time.Second
-		return nil
-	}
-	timeout, err := time.ParseDuration(r.Timeout)
-	if err != nil {
-		return fmt.Errorf("invalid timeout: %s", err)
+	timeout := DefaultTimeout
+	if r.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(r.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid timeout: %s", err)
+		}
 	}
-	if timeout > MaxTimeout {
-		timeout = MaxTimeout
+	if max := lowerLimit(r.maxTimeout, MaxTimeout); timeout > max {
+		timeout = max
 	}
 	r.timeout = timeout
 	return nil
 }
 
+// SetLimits lowers the maximum timeout and global render delay of the request
+// below MaxTimeout and MaxRenderDelay. Zero leaves a limit unchanged. It must
+// be called before ParseRequest.
+func (r *Request) SetLimits(timeout, renderDelay time.Duration) {
+	r.maxTimeout = timeout
+	r.maxRenderDelay = renderDelay
+}
+
+// SetOwner makes the window session and saved tab of the request belong to
+// owner, e.g. the authenticated client. Requests with another owner can't use
+// them.
+func (r *Request) SetOwner(owner string) {
+	r.owner = owner
+}
+
+func lowerLimit(max, global time.Duration) time.Duration {
+	if max > 0 && max < global {
+		return max
+	}
+	return global
+}
+
 func (r *Request) parseQueryBlocks() error {
 
 	if len(r.Query) == 0 {
@@ -253,10 +787,9 @@ func (r *Request) parseQueryBlocks() error {
 		switch r.SessionID {
 		case "":
 			r.SessionID = prefix
-			fmt.Fprintf(os.Stderr, "Loading tab %s, inferring window %s\n",
-				r.oldTabID, r.SessionID)
+			r.log().Info("Loading tab, inferring window", "tab", r.oldTabID)
 		case prefix:
-			fmt.Fprintf(os.Stderr, "Loading tab %s and window %s\n", r.oldTabID, r.SessionID)
+			r.log().Info("Loading tab and window", "tab", r.oldTabID)
 		default:
 			return fmt.Errorf("tab %s is not part of window session %s", r.oldTabID, r.SessionID)
 		}
@@ -272,6 +805,21 @@ func (r *Request) parseQueryBlocks() error {
 	if r.hasListeningEvents() {
 		r.appendActions(network.Enable(), enableLifecycleEvents())
 	}
+	if r.StorageState != nil {
+		if r.oldTabID != "" {
+			return fmt.Errorf("storage_state can't be restored into a tab loaded with load_tab")
+		}
+		r.appendActions(restoreStorageState(r.StorageState, r.storageCookies))
+	}
+	if len(r.cookies) > 0 {
+		r.appendActions(setCookies(r.cookies))
+	}
+	if r.interceptor.enabled() {
+		r.appendActions(r.interceptor.enable())
+	}
+	if r.hidingScript != "" {
+		r.appendActions(r.addHidingScript())
+	}
 
 	r.res.Err = make([]string, len(r.Query))
 	r.res.Out = make([][]string, len(r.Query))
@@ -291,10 +839,14 @@ func (r *Request) parseQueryBlocks() error {
 
 		var xa Action
 		for block.pos, xa = range block.Actions {
+			n := len(block.cdpActions)
 			err = r.parseAction(xa)
 			if err != nil {
 				return fmt.Errorf(efmt, r.pos, block.pos, err)
 			}
+			// time the chromedp actions of each query action as a whole
+			actions := chromedp.Tasks(append([]chromedp.Action(nil), block.cdpActions[n:]...))
+			block.cdpActions = append(block.cdpActions[:n], r.instrument(xa.Name(), actions))
 		}
 
 		if err = r.parseRepeat(); err != nil {
@@ -383,12 +935,35 @@ func (r *Request) parseAction(xa Action) error {
 		}
 		r.appendActions(click(xa.Arg(1)))
 
+	case "clear_cookies":
+		if err = xa.MustArgCount(0); err != nil {
+			return err
+		}
+		r.appendActions(clearCookies())
+
 	case "eval":
 		if err = xa.MustArgCount(1); err != nil {
 			return err
 		}
 		r.appendActions(evaluate(xa.Arg(1), &r.res.Out[r.pos]))
 
+	case "get_cookies":
+		for i, u := range xa.Args() {
+			if _, err = url.ParseRequestURI(u); err != nil {
+				return fmt.Errorf("get_cookies[%d]: non-URL argument: %s", i, err)
+			}
+		}
+		r.appendActions(getCookies(xa.Args(), &r.res.Out[r.pos]))
+
+	case "get_storage_state":
+		for i, origin := range xa.Args() {
+			u, err := url.Parse(origin)
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf(`get_storage_state[%d]: invalid origin "%s"`, i, origin)
+			}
+		}
+		r.appendActions(getStorageState(xa.Args(), &r.res.Out[r.pos]))
+
 	case "hide_nav_buttons":
 		if err = xa.MustArgCount(0); err != nil {
 			return err
@@ -401,7 +976,7 @@ func (r *Request) parseAction(xa Action) error {
 		if err != nil {
 			return fmt.Errorf("listen: %s", err)
 		}
-		r.appendActions(listen(&r.SessionID, events...))
+		r.appendActions(listen(r, events...))
 
 	case "load_tab":
 		if err = xa.MustArgCount(1); err != nil {
@@ -418,6 +993,12 @@ func (r *Request) parseAction(xa Action) error {
 		if err != nil {
 			return fmt.Errorf("navigate: non-URL argument: %s", err)
 		}
+		if err = Policy.checkNavigation(xurl); err != nil {
+			return fmt.Errorf("navigate: %s", err)
+		}
+		if len(r.ExtraHeaders) > 0 {
+			r.fetchInterceptor().allowHeaders(xurl)
+		}
 		r.appendActions(navigate(xurl))
 
 	case "outer_html":
@@ -494,6 +1075,20 @@ func (r *Request) parseAction(xa Action) error {
 			r.appendActions(chromedp.ScrollIntoView(xa.Arg(1), chromedp.ByQuery))
 		}
 
+	case "set_cookies":
+		if err = xa.MustArgCount(1); err != nil {
+			return err
+		}
+		var blocks []*CookieBlock
+		if err = json.Unmarshal([]byte(xa.Arg(1)), &blocks); err != nil {
+			return fmt.Errorf("set_cookies: expected JSON list of cookies: %s", err)
+		}
+		cookies, err := parseCookieBlocks(blocks)
+		if err != nil {
+			return fmt.Errorf("set_cookies%s", err)
+		}
+		r.appendActions(setCookies(cookies))
+
 	case "sleep":
 		if err = xa.MustArgCount(0, 1); err != nil {
 			return err
@@ -556,6 +1151,13 @@ func (r *Request) appendActions(actions ...chromedp.Action) {
 	block.cdpActions = append(block.cdpActions, actions...)
 }
 
+func (r *Request) fetchInterceptor() *interceptor {
+	if r.interceptor == nil {
+		r.interceptor = &interceptor{}
+	}
+	return r.interceptor
+}
+
 func (r *Request) newTab() bool {
 	return r.oldTabID == ""
 }
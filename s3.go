@@ -0,0 +1,301 @@
+package decap
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An S3Store keeps artifacts in a bucket of an S3-compatible object store,
+// using path-style URLs (Endpoint/Bucket/Prefix+name), which AWS and MinIO
+// both accept. Requests are signed with AWS Signature Version 4.
+type S3Store struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// PublicURL, when set, is the base URL of the artifacts returned by
+	// Put. Otherwise Put returns presigned URLs valid for URLExpiry.
+	PublicURL string
+	URLExpiry time.Duration
+	Client    *http.Client
+}
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3TimeFormat      = "20060102T150405Z"
+	s3MaxURLExpiry    = 7 * 24 * time.Hour
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+func (s *S3Store) Put(ctx context.Context, name, contentType string, data []byte) (string, error) {
+	req, err := s.newRequest(ctx, http.MethodPut, s.Prefix+name, nil, data)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if _, err = s.do(req, data); err != nil {
+		return "", err
+	}
+	if s.PublicURL != "" {
+		return strings.TrimSuffix(s.PublicURL, "/") + "/" + escapePath(s.Prefix+name), nil
+	}
+	return s.presign(s.Prefix+name, time.Now())
+}
+
+func (s *S3Store) DeleteBefore(ctx context.Context, t time.Time) (int, error) {
+	var n int
+	var token string
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s.Prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := s.newRequest(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return n, err
+		}
+		body, err := s.do(req, nil)
+		if err != nil {
+			return n, err
+		}
+		var list struct {
+			Contents []struct {
+				Key          string
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err = xml.Unmarshal(body, &list); err != nil {
+			return n, fmt.Errorf("couldn't parse object list: %s", err)
+		}
+		for _, obj := range list.Contents {
+			// leave other objects sharing the bucket and prefix alone
+			name := strings.TrimPrefix(obj.Key, s.Prefix)
+			if !ValidArtifactName(name) || !obj.LastModified.Before(t) {
+				continue
+			}
+			req, err := s.newRequest(ctx, http.MethodDelete, obj.Key, nil, nil)
+			if err != nil {
+				return n, err
+			}
+			if _, err = s.do(req, nil); err != nil {
+				return n, err
+			}
+			n++
+		}
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			return n, nil
+		}
+		token = list.NextContinuationToken
+	}
+}
+
+func (s *S3Store) objectURL(key string, query url.Values) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("endpoint: %s", err)
+	}
+	u.Path += "/" + s.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = escapePath(u.Path)
+	u.RawQuery = canonicalQuery(query)
+	return u, nil
+}
+
+func (s *S3Store) newRequest(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Request, error) {
+	u, err := s.objectURL(key, query)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	return req, nil
+}
+
+func (s *S3Store) do(req *http.Request, body []byte) ([]byte, error) {
+	s.sign(req, body, time.Now())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		var s3Err struct {
+			Code    string
+			Message string
+		}
+		if xml.Unmarshal(buf, &s3Err) == nil && s3Err.Code != "" {
+			return nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, s3Err.Code, s3Err.Message)
+		}
+		return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	return buf, nil
+}
+
+// sign adds the Authorization header of AWS Signature Version 4 to req.
+func (s *S3Store) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := s.scope(now)
+	signature := s.signature(now, scope, canonicalRequest)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.AccessKey, scope, signedHeaders, signature))
+}
+
+// presign returns a URL that allows anyone holding it to get the object for
+// URLExpiry, up to the 7 days allowed by S3.
+func (s *S3Store) presign(key string, now time.Time) (string, error) {
+	now = now.UTC()
+	expiry := s.URLExpiry
+	if expiry <= 0 || expiry > s3MaxURLExpiry {
+		expiry = s3MaxURLExpiry
+	}
+	scope := s.scope(now)
+	query := url.Values{
+		"X-Amz-Algorithm":     {s3Algorithm},
+		"X-Amz-Credential":    {s.AccessKey + "/" + scope},
+		"X-Amz-Date":          {now.Format(s3TimeFormat)},
+		"X-Amz-Expires":       {strconv.Itoa(int(expiry.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	u, err := s.objectURL(key, query)
+	if err != nil {
+		return "", err
+	}
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		s3UnsignedPayload,
+	}, "\n")
+	u.RawQuery += "&X-Amz-Signature=" + s.signature(now, scope, canonicalRequest)
+	return u.String(), nil
+}
+
+func (s *S3Store) scope(now time.Time) string {
+	return fmt.Sprintf("%s/%s/s3/aws4_request", now.Format("20060102"), s.Region)
+}
+
+func (s *S3Store) signature(now time.Time, scope, canonicalRequest string) string {
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		now.Format(s3TimeFormat),
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{now.Format("20060102"), s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// escapePath escapes each segment of a path the way Signature Version 4
+// expects, leaving only unreserved characters unescaped.
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		segments[i] = s3Escape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+// canonicalQuery encodes a query string sorted by key, as Signature Version
+// 4 expects.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,45 @@
+package decap
+
+import "errors"
+
+var (
+	ErrShutdown = errors.New("decap is shutting down")
+
+	shutdownQuery = make(chan struct{})
+	shutdownReply = make(chan int)
+)
+
+// Shutdown closes all window sessions and browsers, and makes later requests
+// for new windows fail with ErrShutdown. It returns the number of windows that
+// were closed. Requests still executing in those windows will fail, so the
+// caller should let them drain first. Shutdown waits for the browsers of
+// persistent profiles to exit, so that they have saved their state.
+func Shutdown() int {
+	shutdownQuery <- struct{}{}
+	n := <-shutdownReply
+	waitForProfile("")
+	return n
+}
+
+// closeAll shuts down every browser in the pool. It must be called from
+// AllocateSessions after the windows of the browsers have been closed.
+func (pool browserPool) closeAll() {
+	for profile, browsers := range pool {
+		for _, b := range browsers {
+			b.cancel()
+		}
+		delete(pool, profile)
+	}
+}
+
+// closeAllWindows shuts down all windows including their saved tabs. It must
+// be called from AllocateSessions.
+func closeAllWindows(windows, tabs *map[string]session) int {
+	n := 0
+	for _, w := range *windows {
+		w.shutdown()
+		removeWindow(w.id, windows, tabs)
+		n++
+	}
+	return n
+}
@@ -0,0 +1,132 @@
+package decap
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	cdpbrowser "github.com/chromedp/cdproto/browser"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/chromedp"
+)
+
+var (
+	started = time.Now()
+
+	browserQuery = make(chan struct{})
+	browserReply = make(chan []browserRef)
+
+	probeSessionID = createSessionID()
+)
+
+type BrowserInfo struct {
+	Profile   string `json:"profile"`
+	Product   string `json:"product"`
+	Revision  string `json:"revision"`
+	UserAgent string `json:"user_agent"`
+	Windows   int    `json:"windows"`
+	Err       string `json:"err,omitempty"`
+}
+
+type StatusInfo struct {
+	Started  time.Time     `json:"started"`
+	Uptime   string        `json:"uptime"`
+	Browsers []BrowserInfo `json:"browsers"`
+	Windows  []WindowInfo  `json:"windows"`
+	Stats    Stats         `json:"stats"`
+}
+
+// A browserRef points at a running browser from outside of AllocateSessions.
+type browserRef struct {
+	ctx     context.Context
+	profile string
+	windows int
+}
+
+// CurrentStatus describes the running browsers, the open windows and the
+// request queues.
+func CurrentStatus() StatusInfo {
+	st := StatusInfo{
+		Started: started,
+		Uptime:  time.Since(started).Round(time.Second).String(),
+		Windows: Windows(),
+		Stats:   CurrentStats(),
+	}
+	browserQuery <- struct{}{}
+	refs := <-browserReply
+	st.Browsers = make([]BrowserInfo, 0, len(refs))
+	for _, ref := range refs {
+		info := BrowserInfo{Profile: ref.profile, Windows: ref.windows}
+		var err error
+		info.Product, info.Revision, info.UserAgent, err = browserVersion(ref.ctx)
+		if err != nil {
+			info.Err = err.Error()
+		}
+		st.Browsers = append(st.Browsers, info)
+	}
+	return st
+}
+
+func browserVersion(ctx context.Context) (product, revision, userAgent string, err error) {
+	c := chromedp.FromContext(ctx)
+	if c == nil || c.Browser == nil {
+		return "", "", "", fmt.Errorf("browser isn't running")
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	_, product, revision, userAgent, _, err = cdpbrowser.GetVersion().Do(cdp.WithExecutor(ctx, c.Browser))
+	return product, revision, userAgent, err
+}
+
+// browserRefs lists the shared browsers and the browsers of windows that run
+// in a process of their own. It must be called from AllocateSessions.
+func browserRefs(windows map[string]session, browsers browserPool) []browserRef {
+	refs := make([]browserRef, 0)
+	for profile, pool := range browsers {
+		for _, b := range pool {
+			refs = append(refs, browserRef{ctx: b.ctx, profile: profile, windows: b.windows})
+		}
+	}
+	for _, w := range windows {
+		if w.browser == nil {
+			refs = append(refs, browserRef{ctx: w.ctx, profile: w.spec.profile, windows: 1})
+		}
+	}
+	sort.SliceStable(refs, func(i, j int) bool { return refs[i].profile < refs[j].profile })
+	return refs
+}
+
+// Probe checks that a tab can be opened and can evaluate JavaScript within
+// timeout. The tab is opened in a dedicated window session, which is closed
+// by the window GC once probing stops.
+func Probe(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		window := loadWindow(probeSessionID, windowSpec{}, "", timeout)
+		if window.err != nil {
+			errc <- window.err
+			return
+		}
+		tab := window.createSiblingTab().withTimeout(timeout)
+		defer tab.shutdown()
+		var res int
+		if err := chromedp.Run(tab.ctx, chromedp.Evaluate("1+1", &res)); err != nil {
+			errc <- err
+			return
+		}
+		if res != 2 {
+			errc <- fmt.Errorf("evaluating 1+1 returned %d", res)
+			return
+		}
+		errc <- nil
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("probe timed out after %s", timeout)
+	}
+}
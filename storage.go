@@ -0,0 +1,224 @@
+package decap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+
+	"github.com/chromedp/cdproto/domstorage"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/cdproto/storage"
+	"github.com/chromedp/chromedp"
+)
+
+// storageRestoredKey marks a tab's sessionStorage once a storage state has
+// been restored into it, so that later navigations don't overwrite it again.
+const storageRestoredKey = "decap:storage-state-restored"
+
+func getStorageState(origins []string, out *[]string) chromedp.ActionFunc {
+	return func(ctx context.Context) error {
+		var state StorageState
+		cookies, err := storage.GetCookies().Do(ctx)
+		if err != nil {
+			return fmt.Errorf("couldn't read cookies: %s", err)
+		}
+		state.Cookies = make([]*CookieBlock, 0, len(cookies))
+		for _, c := range cookies {
+			state.Cookies = append(state.Cookies, cookieBlock(c))
+		}
+
+		var mainOrigin string
+		tree, err := page.GetFrameTree().Do(ctx)
+		if err != nil {
+			return fmt.Errorf("couldn't read frame tree: %s", err)
+		}
+		if tree.Frame != nil {
+			mainOrigin = tree.Frame.SecurityOrigin
+		}
+		if len(origins) == 0 {
+			origins = frameOrigins(tree, nil)
+		}
+
+		if err = domstorage.Enable().Do(ctx); err != nil {
+			return err
+		}
+		state.Origins = make([]*OriginStorage, 0, len(origins))
+		for _, origin := range origins {
+			o := &OriginStorage{Origin: origin}
+			o.LocalStorage, err = domStorageItems(ctx, origin, true)
+			if err != nil {
+				return err
+			}
+			o.SessionStorage, err = domStorageItems(ctx, origin, false)
+			if err != nil {
+				return err
+			}
+			// IndexedDB can only be read from a document of the same origin
+			if origin == mainOrigin {
+				o.IndexedDB, err = indexedDBDatabases(ctx)
+				if err != nil {
+					return err
+				}
+			}
+			state.Origins = append(state.Origins, o)
+		}
+
+		buf, err := json.Marshal(state)
+		*out = append(*out, string(buf))
+		return err
+	}
+}
+
+func restoreStorageState(state *StorageState, cookies []*network.CookieParam) chromedp.ActionFunc {
+	return func(ctx context.Context) error {
+		if len(cookies) > 0 {
+			if err := network.SetCookies(cookies).Do(ctx); err != nil {
+				return fmt.Errorf("couldn't restore cookies: %s", err)
+			}
+		}
+		if len(state.Origins) == 0 {
+			return nil
+		}
+		origins, err := json.Marshal(state.Origins)
+		if err != nil {
+			return err
+		}
+		script := fmt.Sprintf(restoreStorageScriptFmt, origins, storageRestoredKey)
+		_, err = page.AddScriptToEvaluateOnNewDocument(script).Do(ctx)
+		return err
+	}
+}
+
+func frameOrigins(tree *page.FrameTree, origins []string) []string {
+	if tree == nil || tree.Frame == nil {
+		return origins
+	}
+	origin := tree.Frame.SecurityOrigin
+	if u, err := url.Parse(origin); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		seen := false
+		for _, o := range origins {
+			seen = seen || o == origin
+		}
+		if !seen {
+			origins = append(origins, origin)
+		}
+	}
+	for _, child := range tree.ChildFrames {
+		origins = frameOrigins(child, origins)
+	}
+	return origins
+}
+
+func domStorageItems(ctx context.Context, origin string, local bool) ([]*StorageItem, error) {
+	id := &domstorage.StorageID{SecurityOrigin: origin, IsLocalStorage: local}
+	entries, err := domstorage.GetDOMStorageItems(id).Do(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read DOM storage of %s: %s", origin, err)
+	}
+	items := make([]*StorageItem, 0, len(entries))
+	for _, e := range entries {
+		if len(e) != 2 || e[0] == storageRestoredKey {
+			continue
+		}
+		items = append(items, &StorageItem{Name: e[0], Value: e[1]})
+	}
+	return items, nil
+}
+
+func indexedDBDatabases(ctx context.Context) ([]*IndexedDBDatabase, error) {
+	var dbs []*IndexedDBDatabase
+	err := chromedp.Evaluate(dumpIndexedDBScript, &dbs, func(p *runtime.EvaluateParams) *runtime.EvaluateParams {
+		return p.WithAwaitPromise(true)
+	}).Do(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read IndexedDB: %s", err)
+	}
+	if dbs == nil {
+		dbs = make([]*IndexedDBDatabase, 0)
+	}
+	return dbs, nil
+}
+
+func cookieBlock(c *network.Cookie) *CookieBlock {
+	block := &CookieBlock{
+		Name:     c.Name,
+		Value:    c.Value,
+		Domain:   c.Domain,
+		Path:     c.Path,
+		HTTPOnly: c.HTTPOnly,
+		Secure:   c.Secure,
+		SameSite: string(c.SameSite),
+	}
+	if !c.Session {
+		block.Expires = c.Expires
+	}
+	return block
+}
+
+const dumpIndexedDBScript = `(async () => {
+	const request = r => new Promise((resolve, reject) => {
+		r.onsuccess = () => resolve(r.result);
+		r.onerror = () => reject(r.error);
+	});
+	const dbs = [];
+	for (const info of await indexedDB.databases()) {
+		const db = await request(indexedDB.open(info.name));
+		const stores = [];
+		for (const name of db.objectStoreNames) {
+			const store = db.transaction(name, "readonly").objectStore(name);
+			const [keys, values] = await Promise.all([
+				request(store.getAllKeys()), request(store.getAll()),
+			]);
+			stores.push({
+				name: name,
+				keyPath: store.keyPath,
+				autoIncrement: store.autoIncrement,
+				records: keys.map((key, i) => ({key: key, value: values[i]})),
+			});
+		}
+		dbs.push({name: db.name, version: db.version, stores: stores});
+		db.close();
+	}
+	return dbs;
+})()`
+
+const restoreStorageScriptFmt = `(() => {
+	const origins = %s, restoredKey = %q;
+	const state = origins.find(o => o.origin === location.origin);
+	if (!state || sessionStorage.getItem(restoredKey)) {
+		return;
+	}
+	sessionStorage.setItem(restoredKey, "1");
+	for (const item of state.localStorage || []) {
+		localStorage.setItem(item.name, item.value);
+	}
+	for (const item of state.sessionStorage || []) {
+		sessionStorage.setItem(item.name, item.value);
+	}
+	for (const db of state.indexedDB || []) {
+		const open = indexedDB.open(db.name, db.version);
+		open.onupgradeneeded = () => {
+			for (const s of db.stores) {
+				if (!open.result.objectStoreNames.contains(s.name)) {
+					open.result.createObjectStore(s.name, {keyPath: s.keyPath, autoIncrement: s.autoIncrement});
+				}
+			}
+		};
+		open.onsuccess = () => {
+			const conn = open.result;
+			for (const s of db.stores) {
+				if (!conn.objectStoreNames.contains(s.name)) {
+					continue;
+				}
+				const store = conn.transaction(s.name, "readwrite").objectStore(s.name);
+				for (const r of s.records) {
+					s.keyPath === null ? store.put(r.value, r.key) : store.put(r.value);
+				}
+			}
+			conn.close();
+		};
+	}
+})();`
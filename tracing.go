@@ -0,0 +1,48 @@
+package decap
+
+import (
+	"context"
+	"time"
+
+	"github.com/chromedp/chromedp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Spans are created with the global OpenTelemetry tracer provider, so tracing
+// is a no-op unless the program installs one with otel.SetTracerProvider.
+const tracerName = "github.com/jobindex/decap"
+
+func (r *Request) startSpan(name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	parent := r.traceCtx
+	if parent == nil {
+		parent = context.Background()
+	}
+	return otel.Tracer(tracerName).Start(parent, name, trace.WithAttributes(attrs...))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// instrument wraps the chromedp actions of a query action, so that their
+// duration is recorded as a metric and as a span.
+func (r *Request) instrument(name string, action chromedp.Action) chromedp.ActionFunc {
+	return func(ctx context.Context) error {
+		parent := r.traceCtx
+		var span trace.Span
+		r.traceCtx, span = r.startSpan("decap.action", attribute.String("decap.action", name))
+		start := time.Now()
+		err := action.Do(ctx)
+		actionDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+		endSpan(span, err)
+		r.traceCtx = parent
+		return err
+	}
+}
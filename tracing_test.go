@@ -0,0 +1,209 @@
+package decap
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chromedp/chromedp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans installs a tracer provider that exports synchronously to an
+// in-memory exporter.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	return exporter
+}
+
+func spanNamed(t *testing.T, spans tracetest.SpanStubs, name string, attrs ...attribute.KeyValue) tracetest.SpanStub {
+	t.Helper()
+	for _, s := range spans {
+		if s.Name == name && hasAttributes(s, attrs) {
+			return s
+		}
+	}
+	t.Fatalf("no span %s %v among %d spans", name, attrs, len(spans))
+	return tracetest.SpanStub{}
+}
+
+func hasAttributes(s tracetest.SpanStub, attrs []attribute.KeyValue) bool {
+	for _, want := range attrs {
+		found := false
+		for _, kv := range s.Attributes {
+			found = found || kv == want
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func assertChild(t *testing.T, parent, child tracetest.SpanStub) {
+	t.Helper()
+	if child.Parent.SpanID() != parent.SpanContext.SpanID() {
+		t.Errorf("span %s isn't a child of %s", child.Name, parent.Name)
+	}
+	if child.SpanContext.TraceID() != parent.SpanContext.TraceID() {
+		t.Errorf("span %s isn't in the trace of %s", child.Name, parent.Name)
+	}
+}
+
+func mustParse(t *testing.T, body string) *Request {
+	t.Helper()
+	var r Request
+	if err := r.ParseRequest(strings.NewReader(body)); err != nil {
+		t.Fatalf("ParseRequest: %s", err)
+	}
+	return &r
+}
+
+func TestInstrumentNestsActionSpans(t *testing.T) {
+	exporter := recordSpans(t)
+	ctx, root := otel.Tracer("test").Start(context.Background(), "root")
+	r := &Request{traceCtx: ctx}
+
+	errClick := errors.New("no such element")
+	noop := chromedp.ActionFunc(func(context.Context) error { return nil })
+	inner := r.instrument("eval", noop)
+	outer := r.instrument("scroll", chromedp.ActionFunc(func(ctx context.Context) error {
+		return inner.Do(ctx)
+	}))
+	failing := r.instrument("click", chromedp.ActionFunc(func(context.Context) error {
+		return errClick
+	}))
+	if err := outer.Do(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := failing.Do(context.Background()); err != errClick {
+		t.Fatalf("err = %v, want %v", err, errClick)
+	}
+	root.End()
+	if r.traceCtx != ctx {
+		t.Error("instrument didn't restore the request's trace context")
+	}
+
+	spans := exporter.GetSpans()
+	rootSpan := spanNamed(t, spans, "root")
+	scroll := spanNamed(t, spans, "decap.action", attribute.String("decap.action", "scroll"))
+	eval := spanNamed(t, spans, "decap.action", attribute.String("decap.action", "eval"))
+	click := spanNamed(t, spans, "decap.action", attribute.String("decap.action", "click"))
+	assertChild(t, rootSpan, scroll)
+	assertChild(t, scroll, eval)
+	assertChild(t, rootSpan, click)
+	if click.Status.Code != codes.Error {
+		t.Errorf("failed action span status = %v, want Error", click.Status.Code)
+	}
+}
+
+func TestExecuteRecordsQueueSpan(t *testing.T) {
+	exporter := recordSpans(t)
+	defer func(tabs int, wait time.Duration) { MaxTabs, MaxQueueWait = tabs, wait }(MaxTabs, MaxQueueWait)
+	MaxTabs, MaxQueueWait = 1, 10*time.Millisecond
+	if !tabSlots.tryAcquire() {
+		t.Fatal("tab slot is taken")
+	}
+	defer tabSlots.release()
+
+	r := mustParse(t, `{
+		"global_render_delay": "0s",
+		"query": [{"actions": [["navigate", "https://decap.test/"], ["eval", "1"]]}]
+	}`)
+	ctx, root := otel.Tracer("test").Start(context.Background(), "root")
+	_, err := r.ExecuteContext(ctx)
+	root.End()
+	if !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("err = %v, want ErrOverloaded", err)
+	}
+
+	spans := exporter.GetSpans()
+	execute := spanNamed(t, spans, "decap.Execute", attribute.String("decap.request_id", r.ID()))
+	queue := spanNamed(t, spans, "decap.queue")
+	assertChild(t, spanNamed(t, spans, "root"), execute)
+	assertChild(t, execute, queue)
+	if queue.Status.Code != codes.Error || execute.Status.Code != codes.Error {
+		t.Errorf("span statuses = %v, %v, want Error", queue.Status.Code, execute.Status.Code)
+	}
+}
+
+var allocatorOnce sync.Once
+
+// startBrowser skips the test unless Chrome is installed, and otherwise
+// starts AllocateSessions the first time it's called.
+func startBrowser(t *testing.T) {
+	t.Helper()
+	for _, name := range []string{"google-chrome", "google-chrome-stable", "chromium", "chromium-browser", "headless-shell"} {
+		if path, err := exec.LookPath(name); err == nil {
+			allocatorOnce.Do(func() {
+				Launch.Default.ExecPath = path
+				Launch.Default.NoSandbox = true
+				go AllocateSessions()
+			})
+			return
+		}
+	}
+	t.Skip("Chrome isn't installed")
+}
+
+func TestExecuteSpanTree(t *testing.T) {
+	startBrowser(t)
+	exporter := recordSpans(t)
+
+	// the page is served by an intercept rule, so the test needs no network
+	r := mustParse(t, `{
+		"global_render_delay": "0s",
+		"timeout": "20s",
+		"intercept": [{
+			"url": "https://decap.test/*",
+			"action": "fulfil",
+			"body": "<title>Traced</title><h1>Traced</h1>",
+			"headers": {"Content-Type": "text/html"}
+		}],
+		"query": [{"actions": [
+			["navigate", "https://decap.test/"],
+			["listen", "load"],
+			["eval", "document.title"]
+		]}]
+	}`)
+	ctx, root := otel.Tracer("test").Start(context.Background(), "root")
+	res, err := r.ExecuteContext(ctx)
+	root.End()
+	if err != nil {
+		t.Fatalf("ExecuteContext: %s", err)
+	}
+	if len(res.Out) == 0 || len(res.Out[0]) == 0 || res.Out[0][0] != `"Traced"` {
+		t.Errorf("out = %v, want the page title", res.Out)
+	}
+
+	spans := exporter.GetSpans()
+	execute := spanNamed(t, spans, "decap.Execute")
+	assertChild(t, spanNamed(t, spans, "root"), execute)
+	assertChild(t, execute, spanNamed(t, spans, "decap.queue"))
+	assertChild(t, execute, spanNamed(t, spans, "decap.open_tab"))
+	block := spanNamed(t, spans, "decap.block",
+		attribute.Int("decap.block", 0), attribute.Int("decap.iteration", 0))
+	assertChild(t, execute, block)
+	for _, name := range []string{"navigate", "listen", "eval"} {
+		action := spanNamed(t, spans, "decap.action", attribute.String("decap.action", name))
+		assertChild(t, block, action)
+	}
+	for _, s := range spans {
+		if s.SpanKind != trace.SpanKindInternal {
+			t.Errorf("span %s has kind %v, want internal", s.Name, s.SpanKind)
+		}
+	}
+}
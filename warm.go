@@ -0,0 +1,171 @@
+package decap
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/cdproto/storage"
+	"github.com/chromedp/chromedp"
+)
+
+// WarmTabs is the number of blank tabs kept ready per browser for requests
+// that don't use window sessions. In ProcessPerWindow mode it's the total
+// number of warm tabs, each in a browser of its own.
+var WarmTabs int
+
+var (
+	warmQuery = make(chan time.Duration)
+	warmReply = make(chan session)
+	warmReady = make(chan warmTab)
+)
+
+// A warmTab is a blank tab in a window of its own, opened ahead of time.
+type warmTab struct {
+	window session
+	tab    session
+}
+
+// checkoutWarmTab hands out a warm tab, reset and with the given timeout. The
+// tab's window is registered as a regular window session. It reports false if
+// no warm tab is ready.
+func checkoutWarmTab(timeout time.Duration) (session, bool) {
+	warmQuery <- timeout
+	tab := <-warmReply
+	if tab.ctx == nil {
+		return tab, false
+	}
+	tab = tab.withTimeout(timeout)
+	if err := chromedp.Run(tab.ctx, resetTab()); err != nil {
+		tab.shutdown()
+		return session{}, false
+	}
+	return tab, true
+}
+
+func warmTarget() int {
+	if processPerWindow() {
+		return WarmTabs
+	}
+	return WarmTabs * poolSize()
+}
+
+// refillWarmTabs starts preparing warm tabs in the background until there
+// are enough of them, and returns how many it started. It must be called from
+// AllocateSessions.
+func refillWarmTabs(have int, browsers browserPool) int {
+	started := 0
+	for ; have+started < warmTarget(); started++ {
+		if !windowSlots.tryAcquire() {
+			break
+		}
+		w := session{id: createSessionID()}
+		if !processPerWindow() {
+			b, err := browsers.pick("")
+			if err != nil {
+				windowSlots.release()
+				break
+			}
+			w.browser = b
+			w.browser.windows++
+		}
+		go func(w session) {
+			wt := warmTab{window: w.open()}
+			if wt.window.err == nil {
+				wt.tab = wt.window.createSiblingTab()
+				if err := chromedp.Run(wt.tab.ctx); err != nil {
+					wt.window.shutdown()
+					wt.window.err = err
+				}
+			}
+			warmReady <- wt
+		}(w)
+	}
+	return started
+}
+
+// acquireWindowSlot takes a window slot for a new window, discarding idle warm
+// tabs to free one if necessary, since warm tabs count against MaxWindows. A
+// freed slot may go to a request already queued for one instead. It must be
+// called from AllocateSessions.
+func acquireWindowSlot(warm *[]warmTab) bool {
+	for !windowSlots.tryAcquire() {
+		if len(*warm) == 0 {
+			return false
+		}
+		discardWarmTab((*warm)[0])
+		*warm = (*warm)[1:]
+	}
+	return true
+}
+
+// discardWarmTab closes a warm tab that was never checked out. It must be
+// called from AllocateSessions.
+func discardWarmTab(wt warmTab) {
+	if wt.window.ctx != nil && wt.window.err == nil {
+		wt.window.shutdown()
+	}
+	if wt.window.browser != nil {
+		wt.window.browser.windows--
+	}
+	windowSlots.release()
+}
+
+func resetTab() chromedp.ActionFunc {
+	return func(ctx context.Context) error {
+		if err := clearStorage(ctx); err != nil {
+			return err
+		}
+		if err := network.ClearBrowserCookies().Do(ctx); err != nil {
+			return err
+		}
+		if err := network.ClearBrowserCache().Do(ctx); err != nil {
+			return err
+		}
+		return emulation.ClearDeviceMetricsOverride().Do(ctx)
+	}
+}
+
+// clearStorage deletes the sessionStorage of the tab and the localStorage,
+// IndexedDB and other site data of the origins loaded in it and of the origins
+// with cookies in its browser context.
+func clearStorage(ctx context.Context) error {
+	if err := chromedp.Evaluate(clearSessionStorageScript, nil).Do(ctx); err != nil {
+		return err
+	}
+	tree, err := page.GetFrameTree().Do(ctx)
+	if err != nil {
+		return err
+	}
+	origins := frameOrigins(tree, nil)
+	cookies, err := storage.GetCookies().Do(ctx)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, c := range cookies {
+		domain := strings.TrimPrefix(c.Domain, ".")
+		if domain == "" || seen[domain] {
+			continue
+		}
+		seen[domain] = true
+		origins = append(origins, "http://"+domain, "https://"+domain)
+	}
+	for _, origin := range origins {
+		if err := storage.ClearDataForOrigin(origin, "all").Do(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const clearSessionStorageScript = `(() => {
+	try {
+		sessionStorage.clear();
+	} catch (e) {
+		// opaque origins such as about:blank have no storage
+	}
+})()`